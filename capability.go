@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// プロトコルバージョン。
+//
+// メジャーバージョンが異なる相手とは通信できない。
+// マイナーバージョンの違いは Capability のネゴシエーションで吸収する。
+const PROTOCOL_VER = "1.10"
+
+// Capability を持たない旧バージョンのプロトコルバージョン
+const PROTOCOL_VER_LEGACY = "1.00"
+
+// 暗号方式
+const CIPHER_NONE = "none"
+const CIPHER_AES_CFB = "aes-cfb"
+
+// 拡張機能
+// 通信中の暗号鍵の更新 (CTRL_REKEY)
+const FEATURE_REKEY = "rekey"
+
+// フレームのデータ長を uint32 で表現する
+const FEATURE_WIDE_LEN = "wide-len"
+
+// citi の half-close (PACKET_KIND_CLOSE)
+const FEATURE_HALF_CLOSE = "halfclose"
+
+// バイト単位のウィンドウによるフロー制御
+const FEATURE_BYTE_WINDOW = "byte-window"
+
+// コネクションではなくセッションの鍵で、パケットごとに暗号化する (SessionCrypt)
+const FEATURE_SESSION_CIPHER = "session-cipher"
+
+// パケットにシーケンス番号を付ける (PACKET_FLAG_SEQ)
+const FEATURE_SEQ = "seq"
+
+// セッションの終了を PACKET_KIND_EOS で通知する
+const FEATURE_EOS = "eos"
+
+// 再開できないセッションのリセットを PACKET_KIND_RESET で通知する
+const FEATURE_RESET = "reset"
+
+// 通信機能の情報
+//
+// 認証時に、サーバは自分がサポートする機能を AuthChallenge で通知し、
+// クライアントは両者の共通部分を AuthResponse で通知する。
+// サーバは共通部分を確認して、確定した機能を AuthResult で通知する。
+type Capability struct {
+	// 暗号方式のリスト。優先度順。
+	// 確定後は 1 つだけになる。
+	Ciphers []string
+	// 圧縮方式のリスト
+	Compress []string
+	// 1 フレームの最大サイズ
+	MaxFrameSize int
+	// フロー制御のウィンドウサイズ (byte)
+	Window int
+	// keep alive の間隔 (ミリ秒)。 0 の場合は指定なし。
+	KeepAlive int
+	// 拡張機能のリスト
+	Features []string
+}
+
+// 自分がサポートする機能を取得する
+func localCapability(param *TunnelParam) *Capability {
+	ciphers := []string{CIPHER_NONE}
+	if param.encPass != nil && param.encCount != 0 {
+		ciphers = []string{CIPHER_AES_CFB}
+	}
+	features := []string{
+		FEATURE_REKEY, FEATURE_HALF_CLOSE, FEATURE_BYTE_WINDOW, FEATURE_SESSION_CIPHER,
+		FEATURE_SEQ, FEATURE_EOS, FEATURE_RESET}
+	maxFrameSize := BUFSIZE
+	if param.maxFrameSize > BUFSIZE {
+		// BUFSIZE を越えるフレームは uint16 で表現できない
+		maxFrameSize = param.maxFrameSize
+		features = append(features, FEATURE_WIDE_LEN)
+	}
+	return &Capability{
+		Ciphers:      ciphers,
+		Compress:     supportedCompressList,
+		MaxFrameSize: maxFrameSize,
+		Window:       param.window,
+		KeepAlive:    param.keepAliveInterval,
+		Features:     features,
+	}
+}
+
+// Capability を持たない旧バージョンの機能を取得する
+func legacyCapability(param *TunnelParam) *Capability {
+	caps := localCapability(param)
+	caps.Compress = []string{}
+	caps.MaxFrameSize = BUFSIZE
+	caps.Window = PACKET_NUM * BUFSIZE
+	caps.KeepAlive = 0
+	caps.Features = []string{}
+	return caps
+}
+
+// 相手の機能を取得する
+//
+// 旧バージョンの相手は Capability を送ってこないので、旧バージョンの機能とする。
+//
+// @param param TunnelParam
+// @param ver 相手のプロトコルバージョン
+// @param caps 相手の Capability
+// @return *Capability 相手の機能
+// @return error バージョンが不整合の場合
+func peerCapability(
+	param *TunnelParam, ver string, caps *Capability) (*Capability, error) {
+	if err := checkProtocolVer(ver); err != nil {
+		return nil, err
+	}
+	if caps == nil {
+		return legacyCapability(param), nil
+	}
+	return caps, nil
+}
+
+// サーバが確定した機能を取得する
+//
+// サーバが確定した機能は、クライアントが AuthResponse で通知した機能の範囲内に限る。
+// 旧バージョンのサーバは Capability を送ってこないので、通知した機能をそのまま使う。
+//
+// @param caps クライアントが AuthResponse で通知した機能
+// @param resultCaps サーバが AuthResult で通知した機能
+// @return *Capability このセッションで使用する機能
+// @return error 共通の暗号方式がない場合
+func resultCapability(caps *Capability, resultCaps *Capability) (*Capability, error) {
+	if resultCaps == nil {
+		return caps, nil
+	}
+	return negotiateCapability(caps, resultCaps)
+}
+
+// プロトコルバージョンのメジャーバージョンを取得する
+func protocolMajorVer(ver string) (int, error) {
+	major := ver
+	if index := strings.Index(ver, "."); index >= 0 {
+		major = ver[:index]
+	}
+	num, err := strconv.Atoi(major)
+	if err != nil {
+		return 0, fmt.Errorf("illegal protocol version -- '%s'", ver)
+	}
+	return num, nil
+}
+
+// 相手のプロトコルバージョンと通信可能か確認する
+//
+// @param ver 相手のプロトコルバージョン。 "" は旧バージョンとして扱う。
+func checkProtocolVer(ver string) error {
+	if ver == "" {
+		ver = PROTOCOL_VER_LEGACY
+	}
+	peerMajor, err := protocolMajorVer(ver)
+	if err != nil {
+		return err
+	}
+	localMajor, _ := protocolMajorVer(PROTOCOL_VER)
+	if peerMajor != localMajor {
+		return fmt.Errorf(
+			"unsupported protocol version -- peer %s, local %s", ver, PROTOCOL_VER)
+	}
+	return nil
+}
+
+// Capability や鍵交換をサポートしていない旧バージョンかどうか
+//
+// 旧バージョンのクライアントはバージョンを送ってこない。
+// 旧バージョンのサーバは PROTOCOL_VER_LEGACY を送ってくる。
+func isLegacyProtocol(ver string) bool {
+	return ver == "" || ver == PROTOCOL_VER_LEGACY
+}
+
+// 2 つのリストの共通部分を、 list1 の順番で取得する
+func intersectStrList(list1 []string, list2 []string) []string {
+	set := map[string]bool{}
+	for _, item := range list2 {
+		set[item] = true
+	}
+	common := []string{}
+	for _, item := range list1 {
+		if set[item] {
+			common = append(common, item)
+			delete(set, item)
+		}
+	}
+	return common
+}
+
+// 0 を指定なしとして、小さい方を取得する
+func minPositive(val1 int, val2 int) int {
+	if val1 <= 0 {
+		return val2
+	}
+	if val2 <= 0 || val1 < val2 {
+		return val1
+	}
+	return val2
+}
+
+// 2 つの機能の共通部分を取得する
+//
+// @param prefer 優先する側の機能。暗号方式はこちらの優先度で決める。
+// @param other 相手の機能
+// @return *Capability 共通の機能
+// @return error 共通の暗号方式がない場合
+func negotiateCapability(prefer *Capability, other *Capability) (*Capability, error) {
+	ciphers := intersectStrList(prefer.Ciphers, other.Ciphers)
+	if len(ciphers) == 0 {
+		return nil, fmt.Errorf(
+			"no common cipher -- %v, %v", prefer.Ciphers, other.Ciphers)
+	}
+	maxFrameSize := minPositive(prefer.MaxFrameSize, other.MaxFrameSize)
+	if maxFrameSize <= 0 {
+		maxFrameSize = BUFSIZE
+	}
+	window := minPositive(prefer.Window, other.Window)
+	if window <= 0 {
+		window = PACKET_NUM * BUFSIZE
+	} else if window < MIN_WINDOW {
+		window = MIN_WINDOW
+	}
+	// 相手が間隔を指定していない場合は、 keep alive での生存確認をしない。
+	// 相手が極端に短い間隔を指定しても、下限までにする。
+	keepAlive := 0
+	if prefer.KeepAlive > 0 && other.KeepAlive > 0 {
+		keepAlive = minPositive(prefer.KeepAlive, other.KeepAlive)
+		if keepAlive < KEEP_ALIVE_INTERVAL_MIN {
+			keepAlive = KEEP_ALIVE_INTERVAL_MIN
+		}
+	}
+	features := intersectStrList(prefer.Features, other.Features)
+	caps := &Capability{
+		Ciphers:      ciphers[:1],
+		Compress:     intersectStrList(prefer.Compress, other.Compress),
+		MaxFrameSize: maxFrameSize,
+		Window:       window,
+		KeepAlive:    keepAlive,
+		Features:     features,
+	}
+	if !caps.hasFeature(FEATURE_WIDE_LEN) && caps.MaxFrameSize > BUFSIZE {
+		caps.MaxFrameSize = BUFSIZE
+	}
+	return caps, nil
+}
+
+// 拡張機能が有効かどうか
+func (caps *Capability) hasFeature(feature string) bool {
+	if caps == nil {
+		return false
+	}
+	for _, item := range caps.Features {
+		if item == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// 機能の文字列表現
+func (caps *Capability) String() string {
+	if caps == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf(
+		"cipher %v, compress %v, frame %d, window %d, keepalive %d, features %v",
+		caps.Ciphers, caps.Compress, caps.MaxFrameSize, caps.Window,
+		caps.KeepAlive, caps.Features)
+}
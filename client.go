@@ -9,16 +9,17 @@ import (
 )
 
 func connectTunnel(
-	serverInfo HostInfo,
-	param *TunnelParam, forwardList []ForwardInfo) ([]ForwardInfo, ReconnectInfo) {
+	serverInfo HostInfo, param *TunnelParam, sessionInfo *SessionInfo,
+	forwardList []ForwardInfo) ([]ForwardInfo, ReconnectInfo) {
 	log.Printf("start client --- %d", serverInfo.Port)
-	tunnel, err := net.Dial("tcp", fmt.Sprintf("%s:%d", serverInfo.Name, serverInfo.Port))
+	tunnel, err := net.Dial("tcp", net.JoinHostPort(serverInfo.Name, fmt.Sprint(serverInfo.Port)))
 	if err != nil {
 		return nil, ReconnectInfo{nil, true, fmt.Errorf("failed to connect -- %s", err)}
 	}
 	log.Print("connected to server")
 
-	connInfo := CreateConnInfo(tunnel, param.encPass, param.encCount, nil, false)
+	// 再接続の場合は、同じセッションを再開する
+	connInfo := CreateConnInfo(tunnel, param.encPass, param.encCount, sessionInfo, false)
 	overrideForwardList := forwardList
 	cont := true
 	overrideForwardList, cont, err = ProcessClientAuth(connInfo, param, forwardList)
@@ -32,44 +33,40 @@ func connectTunnel(
 }
 
 func StartClient(param *TunnelParam, forwardList []ForwardInfo) {
-	listenGroup := NewListen(forwardList)
+	listenGroup, err := NewListen(forwardList)
+	if err != nil {
+		log.Printf("failed to listen -- %s", err)
+		return
+	}
 	defer listenGroup.Close()
 
-	for {
-		sessionParam := *param
-		_, reconnectInfo := connectTunnel(
-			param.serverInfo, &sessionParam, forwardList)
-		if reconnectInfo.Err != nil {
-			break
-		}
-		defer reconnectInfo.Conn.Conn.Close()
-
-		reconnect := CreateToReconnectFunc(
-			func(sessionInfo *SessionInfo) ReconnectInfo {
-				_, reconnectInfo :=
-					connectTunnel(param.serverInfo, &sessionParam, forwardList)
-				return reconnectInfo
-			})
-		ListenNewConnect(listenGroup, reconnectInfo.Conn, &sessionParam, true, reconnect)
-	}
+	sessionParam := *param
+	connect := CreateToReconnectFunc(
+		&param.reconnectPolicy,
+		func(sessionInfo *SessionInfo) ReconnectInfo {
+			_, reconnectInfo := connectTunnel(
+				param.serverInfo, &sessionParam, sessionInfo, forwardList)
+			return reconnectInfo
+		})
+	superviseSession(connect, func(connInfo *ConnInfo) bool {
+		ListenNewConnect(listenGroup, connInfo, &sessionParam, true, connect)
+		return true
+	})
 }
 
 func StartReverseClient(param *TunnelParam) {
-	for {
-		sessionParam := *param
-		_, reconnectInfo := connectTunnel(param.serverInfo, &sessionParam, nil)
-		if reconnectInfo.Err != nil {
-			break
-		}
-		defer reconnectInfo.Conn.Conn.Close()
-
-		reconnect := CreateToReconnectFunc(
-			func(sessionInfo *SessionInfo) ReconnectInfo {
-				_, reconnectInfo := connectTunnel(param.serverInfo, &sessionParam, nil)
-				return reconnectInfo
-			})
-		NewConnectFromWith(reconnectInfo.Conn, &sessionParam, reconnect)
-	}
+	sessionParam := *param
+	connect := CreateToReconnectFunc(
+		&param.reconnectPolicy,
+		func(sessionInfo *SessionInfo) ReconnectInfo {
+			_, reconnectInfo := connectTunnel(
+				param.serverInfo, &sessionParam, sessionInfo, nil)
+			return reconnectInfo
+		})
+	superviseSession(connect, func(connInfo *ConnInfo) bool {
+		NewConnectFromWith(connInfo, &sessionParam, connect)
+		return true
+	})
 }
 
 func StartWebSocketClient(
@@ -77,46 +74,50 @@ func StartWebSocketClient(
 	serverInfo HostInfo, proxyHost string, forwardList []ForwardInfo) {
 
 	sessionParam := *param
-	forwardList, reconnectInfo := ConnectWebScoket(
-		serverInfo.toStr(), proxyHost, userAgent, &sessionParam, nil, forwardList)
-	if reconnectInfo.Err != nil {
-		return
-	}
-	defer reconnectInfo.Conn.Conn.Close()
-
-	listenGroup := NewListen(forwardList)
-	defer listenGroup.Close()
-
-	reconnect := CreateToReconnectFunc(
+	// 待ち受けるポートは、最初のセッションでサーバから指定されたものを使い続ける
+	var listenGroup *ListenGroup
+	listenForwardList := forwardList
+	connect := CreateToReconnectFunc(
+		&param.reconnectPolicy,
 		func(sessionInfo *SessionInfo) ReconnectInfo {
-			_, reconnectInfo := ConnectWebScoket(
+			overrideForwardList, reconnectInfo := ConnectWebScoket(
 				serverInfo.toStr(), proxyHost, userAgent,
 				&sessionParam, sessionInfo, forwardList)
+			if listenGroup == nil && reconnectInfo.Err == nil {
+				listenForwardList = overrideForwardList
+			}
 			return reconnectInfo
 		})
-	ListenNewConnect(listenGroup, reconnectInfo.Conn, &sessionParam, true, reconnect)
+	superviseSession(connect, func(connInfo *ConnInfo) bool {
+		if listenGroup == nil {
+			var err error
+			if listenGroup, err = NewListen(listenForwardList); err != nil {
+				log.Printf("failed to listen -- %s", err)
+				return false
+			}
+		}
+		ListenNewConnect(listenGroup, connInfo, &sessionParam, true, connect)
+		return true
+	})
+	if listenGroup != nil {
+		listenGroup.Close()
+	}
 }
 
 func StartReverseWebSocketClient(
 	userAgent string, param *TunnelParam, serverInfo HostInfo, proxyHost string) {
 
 	sessionParam := *param
-
 	connect := CreateToReconnectFunc(
+		&param.reconnectPolicy,
 		func(sessionInfo *SessionInfo) ReconnectInfo {
 			_, reconnectInfo := ConnectWebScoket(
 				serverInfo.toStr(), proxyHost,
 				userAgent, &sessionParam, sessionInfo, nil)
 			return reconnectInfo
 		})
-
-	process := func() {
-		connInfo := connect(nil)
-		defer connInfo.Conn.Close()
-
+	superviseSession(connect, func(connInfo *ConnInfo) bool {
 		NewConnectFromWith(connInfo, &sessionParam, connect)
-	}
-	for {
-		process()
-	}
+		return true
+	})
 }
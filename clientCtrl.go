@@ -1,13 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 var controlMutex = new(sync.Mutex)
@@ -15,8 +23,109 @@ var client2count = map[string]int{}
 
 const MAX_SESSION_PER_CLIENT = 2
 
+// ロックアウトを開始する認証失敗回数
+const AUTH_FAIL_THRESHOLD = 3
+
+// ロックアウト時間の上限
+const LOCKOUT_MAX = time.Hour
+
+// IP 制限のルールファイルの更新を確認する間隔
+const IP_FILTER_CHECK_INTERVAL = 5 * time.Second
+
+// client2state の不要なエントリを掃除する間隔
+const CLIENT_STATE_SWEEP_INTERVAL = time.Minute
+
 var pattern = regexp.MustCompile(":[ 0-9]+$")
 
+// 接続元クライアントの制限パラメータ
+type ClientLimit struct {
+	// 1 IP あたりの最大セッション数
+	maxSessionPerClient int
+	// 全クライアントでの新規ハンドシェイク数の上限 (回/秒)。 0 なら制限しない。
+	handshakeRate float64
+	// 1 IP あたりの新規ハンドシェイク数の上限 (回/秒)。 0 なら制限しない。
+	handshakeRatePerClient float64
+	// 最初のロックアウト時間。 0 ならロックアウトしない。
+	lockoutBase time.Duration
+	// 同時に処理する認証前のハンドシェイク数の上限。 0 なら制限しない。
+	maxHandshake int
+}
+
+// トークンバケットによるレート制限
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// トークンを 1 つ取得する
+//
+// @param rate 1 秒あたりに補充するトークン数
+// @param now 現在時刻
+// @return bool 取得できた場合 true
+func (bucket *rateBucket) take(rate float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	if bucket.last.IsZero() {
+		bucket.tokens = burst
+	} else {
+		bucket.tokens += now.Sub(bucket.last).Seconds() * rate
+		if bucket.tokens > burst {
+			bucket.tokens = burst
+		}
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// 接続元 IP ごとの状態
+type clientState struct {
+	// 連続した認証失敗回数
+	failCount int
+	// この時刻まで接続を拒否する
+	lockUntil time.Time
+	// ハンドシェイクのレート制限
+	bucket rateBucket
+}
+
+var client2state = map[string]*clientState{}
+
+// 処理中の認証前のハンドシェイク数
+var handshakeCount = 0
+var globalBucket = rateBucket{}
+var lastSweep = time.Now()
+
+func getClientState(ipTxt string) *clientState {
+	state, has := client2state[ipTxt]
+	if !has {
+		state = &clientState{}
+		client2state[ipTxt] = state
+	}
+	return state
+}
+
+// 不要になった client2state のエントリを削除する
+func sweepClientState(now time.Time) {
+	if now.Sub(lastSweep) < CLIENT_STATE_SWEEP_INTERVAL {
+		return
+	}
+	lastSweep = now
+	for ipTxt, state := range client2state {
+		if state.failCount == 0 && now.After(state.lockUntil) &&
+			now.Sub(state.bucket.last) > CLIENT_STATE_SWEEP_INTERVAL {
+			delete(client2state, ipTxt)
+		}
+	}
+}
+
 type MaskIP struct {
 	ip   net.IP
 	mask net.IPMask
@@ -27,6 +136,9 @@ func (maskIP *MaskIP) inRange(ip net.IP) bool {
 }
 
 func remoteAddr2ip(remoteAddr string) net.IP {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return net.ParseIP(host)
+	}
 	if loc := pattern.FindStringIndex(remoteAddr); loc != nil {
 		remoteAddr = remoteAddr[:loc[0]]
 	}
@@ -48,6 +160,9 @@ func ippattern2MaskIP(ipPattern string) (*MaskIP, error) {
 		}
 	}
 	ip := net.ParseIP(ipTxt)
+	if ip == nil {
+		return nil, fmt.Errorf("illegal ip -- %s", ipPattern)
+	}
 	maxBit := 4 * 8
 	if strings.Index(ipTxt, ":") != -1 {
 		maxBit = 16 * 8
@@ -63,6 +178,321 @@ func ippattern2MaskIP(ipPattern string) (*MaskIP, error) {
 	return &MaskIP{work, mask}, nil
 }
 
+// IP 制限のルール
+type IPRule struct {
+	// 許可するルールの場合 true。拒否するルールの場合 false。
+	allow  bool
+	maskIP *MaskIP
+}
+
+// IP 制限のルールリスト
+type IPFilter struct {
+	// -ip で指定されたルール
+	baseRuleList []IPRule
+	// ルールファイルから読み込んだルール
+	fileRuleList []IPRule
+	// ルールファイルのパス。 "" の場合はファイル無し。
+	path string
+	// 読み込んだルールファイルの更新時刻
+	modTime time.Time
+	// ルールリストアクセス排他用 mutex
+	mutex sync.Mutex
+}
+
+// ルール文字列を IPRule に変換する
+//
+// 次の書式を受け付ける。
+//   - "192.168.0.0/24", "allow 192.168.0.0/24" : 許可
+//   - "!10.0.0.0/8", "deny 10.0.0.0/8" : 拒否
+func text2IPRule(txt string) (*IPRule, error) {
+	allow := true
+	tokenList := strings.Fields(txt)
+	switch len(tokenList) {
+	case 1:
+		txt = tokenList[0]
+		if strings.HasPrefix(txt, "!") {
+			allow = false
+			txt = txt[1:]
+		}
+	case 2:
+		switch tokenList[0] {
+		case "allow":
+		case "deny":
+			allow = false
+		default:
+			return nil, fmt.Errorf("illegal rule -- %s", txt)
+		}
+		txt = tokenList[1]
+	default:
+		return nil, fmt.Errorf("illegal rule -- %s", txt)
+	}
+	maskIP, err := ippattern2MaskIP(txt)
+	if err != nil {
+		return nil, err
+	}
+	return &IPRule{allow, maskIP}, nil
+}
+
+// ',' 区切りのルールリストを解析する
+func ippattern2RuleList(ipPattern string) ([]IPRule, error) {
+	ruleList := []IPRule{}
+	for _, txt := range strings.Split(ipPattern, ",") {
+		if strings.TrimSpace(txt) == "" {
+			continue
+		}
+		rule, err := text2IPRule(txt)
+		if err != nil {
+			return nil, err
+		}
+		ruleList = append(ruleList, *rule)
+	}
+	return ruleList, nil
+}
+
+// ルールファイルを読み込む
+//
+// 1 行に 1 ルールを記述する。 '#' 以降はコメント。
+func loadIPRuleFile(path string) ([]IPRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ruleList := []IPRule{}
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if index := strings.Index(line, "#"); index != -1 {
+			line = line[:index]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rule, err := text2IPRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, lineNo, err)
+		}
+		ruleList = append(ruleList, *rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ruleList, nil
+}
+
+// IPFilter を生成する
+//
+// @param ipPattern ',' 区切りのルール。
+// @param path ルールファイルのパス。 "" の場合はファイル無し。
+func NewIPFilter(ipPattern string, path string) (*IPFilter, error) {
+	baseRuleList, err := ippattern2RuleList(ipPattern)
+	if err != nil {
+		return nil, err
+	}
+	filter := &IPFilter{baseRuleList: baseRuleList, path: path}
+	if path != "" {
+		if err := filter.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+// ルールファイルを読み込み直す。
+//
+// 読み込みに失敗した場合は、現在のルールを維持する。
+func (filter *IPFilter) reload() error {
+	stat, err := os.Stat(filter.path)
+	if err != nil {
+		return err
+	}
+	ruleList, err := loadIPRuleFile(filter.path)
+	if err != nil {
+		return err
+	}
+
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+
+	filter.fileRuleList = ruleList
+	filter.modTime = stat.ModTime()
+	log.Printf("load ip rule -- %s, %d", filter.path, len(ruleList))
+	return nil
+}
+
+// ルールファイルが更新されていたら読み込み直す
+func (filter *IPFilter) reloadIfModified() {
+	stat, err := os.Stat(filter.path)
+	if err != nil {
+		log.Printf("failed to check ip rule -- %s", err)
+		return
+	}
+	filter.mutex.Lock()
+	modTime := filter.modTime
+	filter.mutex.Unlock()
+
+	if !stat.ModTime().Equal(modTime) {
+		if err := filter.reload(); err != nil {
+			log.Printf("failed to reload ip rule -- %s", err)
+		}
+	}
+}
+
+// ルールファイルの更新と SIGHUP を監視して、ルールを読み込み直す。
+//
+// 既に確立しているセッションには影響しない。
+func (filter *IPFilter) Watch() {
+	if filter.path == "" {
+		return
+	}
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGHUP)
+	ticker := time.NewTicker(IP_FILTER_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sigchan:
+			log.Print("SIGHUP: reload ip rule")
+			if err := filter.reload(); err != nil {
+				log.Printf("failed to reload ip rule -- %s", err)
+			}
+		case <-ticker.C:
+			filter.reloadIfModified()
+		}
+	}
+}
+
+// 指定の IP が接続可能か判定する
+//
+// -ip のルール、ルールファイルのルールの順で評価し、最初にマッチしたルールに従う。
+// どのルールにもマッチしない場合、許可ルールが 1 つでもあれば拒否し、
+// 拒否ルールだけの場合は許可する。
+func (filter *IPFilter) isAllowed(ip net.IP) bool {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+
+	hasAllow := false
+	for _, ruleList := range [][]IPRule{filter.baseRuleList, filter.fileRuleList} {
+		for _, rule := range ruleList {
+			if rule.maskIP.inRange(ip) {
+				return rule.allow
+			}
+			if rule.allow {
+				hasAllow = true
+			}
+		}
+	}
+	return !hasAllow
+}
+
+// 信頼する proxy のアドレスリストを解析する
+func ippattern2MaskIPList(ipPattern string) ([]*MaskIP, error) {
+	list := []*MaskIP{}
+	for _, txt := range strings.Split(ipPattern, ",") {
+		if txt = strings.TrimSpace(txt); txt == "" {
+			continue
+		}
+		maskIP, err := ippattern2MaskIP(txt)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, maskIP)
+	}
+	return list, nil
+}
+
+// 指定の IP が信頼する proxy かどうか
+func isTrustedProxy(param *TunnelParam, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, maskIP := range param.trustedProxyList {
+		if maskIP.inRange(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Forwarded ヘッダから for= のアドレスリストを取得する
+//
+// Forwarded: for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"
+func parseForwardedHeader(value string) []string {
+	list := []string{}
+	for _, element := range strings.Split(value, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			pair = strings.TrimSpace(pair)
+			if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+				continue
+			}
+			list = append(list, strings.Trim(pair[4:], "\""))
+		}
+	}
+	return list
+}
+
+// X-Forwarded-For, Forwarded の 1 要素から IP を取得する
+func forwardedAddr2ip(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+// X-Forwarded-For, Forwarded の 1 要素から host:port を取得する
+//
+// 要素にポートが無い場合は、直接の接続元のポートを使う。
+//
+// @param addr ヘッダの要素
+// @param ip addr から取得した IP
+// @param remoteAddr 直接の接続元アドレス
+func forwardedAddr2hostPort(addr string, ip net.IP, remoteAddr string) string {
+	_, port, err := net.SplitHostPort(strings.TrimSpace(addr))
+	if err != nil {
+		if _, port, err = net.SplitHostPort(remoteAddr); err != nil {
+			port = "0"
+		}
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
+
+// HTTP リクエストの接続元アドレスを取得する
+//
+// 直接の接続元が信頼する proxy の場合、
+// Forwarded, X-Forwarded-For ヘッダから接続元を取得する。
+// ヘッダのアドレスは後ろから順に確認し、
+// 信頼する proxy 以外の最初のアドレスを接続元とする。
+func getHttpClientAddr(req *http.Request, param *TunnelParam) string {
+	if !isTrustedProxy(param, remoteAddr2ip(req.RemoteAddr)) {
+		return req.RemoteAddr
+	}
+	addrList := []string{}
+	if values := req.Header.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			addrList = append(addrList, parseForwardedHeader(value)...)
+		}
+	} else {
+		for _, value := range req.Header.Values("X-Forwarded-For") {
+			addrList = append(addrList, strings.Split(value, ",")...)
+		}
+	}
+	for index := len(addrList) - 1; index >= 0; index-- {
+		ip := forwardedAddr2ip(addrList[index])
+		if ip == nil {
+			log.Printf("illegal forwarded address -- %s", addrList[index])
+			break
+		}
+		if !isTrustedProxy(param, ip) || index == 0 {
+			return forwardedAddr2hostPort(addrList[index], ip, req.RemoteAddr)
+		}
+	}
+	return req.RemoteAddr
+}
+
 func AcceptClient(remoteAddr string, param *TunnelParam) error {
 	controlMutex.Lock()
 	defer controlMutex.Unlock()
@@ -70,15 +500,31 @@ func AcceptClient(remoteAddr string, param *TunnelParam) error {
 	remoteIP := remoteAddr2ip(remoteAddr)
 	ipTxt := remoteIP.String()
 
-	if param.maskedIP != nil {
+	if param.ipFilter != nil {
 		// 接続元のアドレスをチェックする
-		if !param.maskedIP.inRange(remoteIP) {
+		if !param.ipFilter.isAllowed(remoteIP) {
 			return fmt.Errorf("unmatch ip -- %s", ipTxt)
 		}
 	}
 
+	now := time.Now()
+	sweepClientState(now)
+
+	state := getClientState(ipTxt)
+	if now.Before(state.lockUntil) {
+		return fmt.Errorf(
+			"locked out -- %s, %s", ipTxt, state.lockUntil.Sub(now).Round(time.Second))
+	}
+	limit := &param.clientLimit
+	if !state.bucket.take(limit.handshakeRatePerClient, now) {
+		return fmt.Errorf("handshake rate over -- %s", ipTxt)
+	}
+	if !globalBucket.take(limit.handshakeRate, now) {
+		return fmt.Errorf("global handshake rate over -- %s", ipTxt)
+	}
+
 	val, has := client2count[ipTxt]
-	if has && val >= MAX_SESSION_PER_CLIENT {
+	if has && val >= limit.maxSessionPerClient {
 		return fmt.Errorf("session over -- %s", ipTxt)
 	}
 	log.Printf("client: '%s(%s)' -- %d", ipTxt, remoteAddr, val+1)
@@ -91,14 +537,94 @@ func ReleaseClient(remoteAddr string) {
 	controlMutex.Lock()
 	defer controlMutex.Unlock()
 
-	if loc := pattern.FindStringIndex(remoteAddr); loc != nil {
-		remoteAddr = remoteAddr[:loc[0]]
-	}
+	ipTxt := remoteAddr2ip(remoteAddr).String()
 
-	val := client2count[remoteAddr]
-	if val == 1 {
-		delete(client2count, remoteAddr)
+	val := client2count[ipTxt]
+	if val <= 1 {
+		delete(client2count, ipTxt)
 	} else {
-		client2count[remoteAddr] = val - 1
+		client2count[ipTxt] = val - 1
+	}
+}
+
+// 認証前のハンドシェイクを開始する
+//
+// 処理中のハンドシェイク数が上限を越える場合はエラーを返す。
+// エラーでない場合、ハンドシェイク終了時に EndHandshake() をコールすること。
+func BeginHandshake(param *TunnelParam) error {
+	controlMutex.Lock()
+	defer controlMutex.Unlock()
+
+	maxHandshake := param.clientLimit.maxHandshake
+	if maxHandshake > 0 && handshakeCount >= maxHandshake {
+		return fmt.Errorf("handshake over -- %d", handshakeCount)
+	}
+	handshakeCount++
+	return nil
+}
+
+// 認証前のハンドシェイクを終了する
+func EndHandshake() {
+	controlMutex.Lock()
+	defer controlMutex.Unlock()
+
+	handshakeCount--
+}
+
+// 認証結果を登録する
+//
+// 認証失敗が AUTH_FAIL_THRESHOLD 回続くと、その IP をロックアウトする。
+// ロックアウト時間は、失敗する毎に倍になる。
+//
+// @param remoteAddr 接続元のアドレス
+// @param success 認証成功の場合 true
+// @param param Tunnel情報
+func NotifyAuthResult(remoteAddr string, success bool, param *TunnelParam) {
+	controlMutex.Lock()
+	defer controlMutex.Unlock()
+
+	ipTxt := remoteAddr2ip(remoteAddr).String()
+	state := getClientState(ipTxt)
+	if success {
+		state.failCount = 0
+		return
+	}
+	state.failCount++
+	lockoutBase := param.clientLimit.lockoutBase
+	if lockoutBase <= 0 || state.failCount < AUTH_FAIL_THRESHOLD {
+		return
+	}
+	lockout := LOCKOUT_MAX
+	if shift := state.failCount - AUTH_FAIL_THRESHOLD; shift < 32 {
+		lockout = lockoutBase << uint(shift)
+		if lockout > LOCKOUT_MAX || lockout <= 0 {
+			lockout = LOCKOUT_MAX
+		}
+	}
+	state.lockUntil = time.Now().Add(lockout)
+	log.Printf("lockout -- %s, fail %d, %s", ipTxt, state.failCount, lockout)
+}
+
+// ロックアウト中の IP 一覧を出力する
+func DumpBanList(stream io.Writer) {
+	controlMutex.Lock()
+	defer controlMutex.Unlock()
+
+	now := time.Now()
+	ipList := []string{}
+	for ipTxt, state := range client2state {
+		if now.Before(state.lockUntil) {
+			ipList = append(ipList, ipTxt)
+		}
+	}
+	sort.Strings(ipList)
+
+	fmt.Fprintf(stream, "------------\n")
+	for _, ipTxt := range ipList {
+		state := client2state[ipTxt]
+		fmt.Fprintf(
+			stream, "%s: fail %d, remain %s\n", ipTxt, state.failCount,
+			state.lockUntil.Sub(now).Round(time.Second))
 	}
+	fmt.Fprintf(stream, "ban: %d\n", len(ipList))
 }
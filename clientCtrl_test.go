@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// バースト分を取得した後は、レートに応じて補充されることを確認する
+func TestRateBucket(t *testing.T) {
+	now := time.Now()
+	bucket := rateBucket{}
+	for count := 0; count < 2; count++ {
+		if !bucket.take(2, now) {
+			t.Fatalf("can't take burst -- %d", count)
+		}
+	}
+	if bucket.take(2, now) {
+		t.Errorf("take over burst")
+	}
+	// 0.5 秒で 1 つ補充される
+	now = now.Add(250 * time.Millisecond)
+	if bucket.take(2, now) {
+		t.Errorf("take before refill")
+	}
+	now = now.Add(250 * time.Millisecond)
+	if !bucket.take(2, now) {
+		t.Errorf("can't take after refill")
+	}
+	// 長時間経過しても、バースト分までしか溜まらない
+	now = now.Add(time.Hour)
+	for count := 0; count < 2; count++ {
+		if !bucket.take(2, now) {
+			t.Fatalf("can't take burst -- %d", count)
+		}
+	}
+	if bucket.take(2, now) {
+		t.Errorf("take over burst after long time")
+	}
+}
+
+// 1 未満のレートでも 1 つは取得でき、 0 以下のレートは制限しないことを確認する
+func TestRateBucketLowRate(t *testing.T) {
+	now := time.Now()
+	bucket := rateBucket{}
+	if !bucket.take(0.1, now) {
+		t.Errorf("can't take first token")
+	}
+	if bucket.take(0.1, now.Add(5*time.Second)) {
+		t.Errorf("take before refill")
+	}
+	if !bucket.take(0.1, now.Add(15*time.Second)) {
+		t.Errorf("can't take after refill")
+	}
+
+	bucket = rateBucket{}
+	for count := 0; count < 100; count++ {
+		if !bucket.take(0, now) {
+			t.Fatalf("unlimited rate is limited -- %d", count)
+		}
+	}
+}
+
+func TestText2IPRule(t *testing.T) {
+	testList := []struct {
+		txt   string
+		allow bool
+		err   bool
+	}{
+		{"192.168.0.0/24", true, false},
+		{"allow 192.168.0.0/24", true, false},
+		{"!10.0.0.0/8", false, false},
+		{"deny 10.0.0.0/8", false, false},
+		{"  deny   2001:db8::/32 ", false, false},
+		{"permit 10.0.0.0/8", false, true},
+		{"deny", false, true},
+		{"deny 10.0.0.0/8 x", false, true},
+		{"host", false, true},
+		{"10.0.0.0/x", false, true},
+	}
+	for _, test := range testList {
+		rule, err := text2IPRule(test.txt)
+		if test.err {
+			if err == nil {
+				t.Errorf("no error -- %s", test.txt)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.txt, err)
+			continue
+		}
+		if rule.allow != test.allow {
+			t.Errorf("unmatch allow -- %s, %v", test.txt, rule.allow)
+		}
+	}
+}
+
+// IP 制限のルールで、接続元 IP を判定する
+func checkIPFilter(t *testing.T, filter *IPFilter, ip2allow map[string]bool) {
+	t.Helper()
+	for ipTxt, allow := range ip2allow {
+		if filter.isAllowed(net.ParseIP(ipTxt)) != allow {
+			t.Errorf("unmatch allow -- %s, %v", ipTxt, allow)
+		}
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	testList := []struct {
+		pattern  string
+		ip2allow map[string]bool
+	}{
+		// ルールがなければ全て許可
+		{"", map[string]bool{"192.168.0.1": true}},
+		// 許可ルールだけの場合、マッチしないものは拒否
+		{"192.168.0.0/24,2001:db8::/32", map[string]bool{
+			"192.168.0.1": true, "192.168.1.1": false,
+			"2001:db8::1": true, "2001:db9::1": false}},
+		// 拒否ルールだけの場合、マッチしないものは許可
+		{"!10.0.0.0/8", map[string]bool{"10.0.0.1": false, "192.168.0.1": true}},
+		// 最初にマッチしたルールに従う
+		{"!192.168.0.1,192.168.0.0/24", map[string]bool{
+			"192.168.0.1": false, "192.168.0.2": true, "10.0.0.1": false}},
+		{"192.168.0.0/24,!192.168.0.1", map[string]bool{
+			"192.168.0.1": true, "10.0.0.1": false}},
+	}
+	for _, test := range testList {
+		filter, err := NewIPFilter(test.pattern, "")
+		if err != nil {
+			t.Fatalf("%s: %s", test.pattern, err)
+		}
+		checkIPFilter(t, filter, test.ip2allow)
+	}
+	if _, err := NewIPFilter("192.168.0.0/24,host", ""); err == nil {
+		t.Errorf("no error for illegal pattern")
+	}
+}
+
+// ルールファイルの読み込みと、更新時の読み込み直しを確認する
+func TestIPFilterFile(t *testing.T) {
+	discardLog(t)
+	path := filepath.Join(t.TempDir(), "ip.rule")
+	writeRule := func(txt string, modTime time.Time) {
+		if err := os.WriteFile(path, []byte(txt), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modTime := time.Now().Add(-time.Hour)
+	writeRule("# comment\n\ndeny 192.168.0.1 # host\n192.168.0.0/24\n", modTime)
+
+	if _, err := NewIPFilter("", path+".none"); err == nil {
+		t.Errorf("no error for missing file")
+	}
+	// -ip のルールを、ファイルのルールより先に評価する
+	filter, err := NewIPFilter("192.168.0.1", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIPFilter(t, filter, map[string]bool{
+		"192.168.0.1": true, "192.168.0.2": true, "10.0.0.1": false})
+
+	// 更新時刻が変わらなければ読み込まない
+	writeRule("10.0.0.0/8\n", modTime)
+	filter.reloadIfModified()
+	checkIPFilter(t, filter, map[string]bool{"192.168.0.2": true, "10.0.0.1": false})
+
+	modTime = modTime.Add(time.Minute)
+	writeRule("10.0.0.0/8\n", modTime)
+	filter.reloadIfModified()
+	checkIPFilter(t, filter, map[string]bool{"192.168.0.2": false, "10.0.0.1": true})
+
+	// 不正なルールファイルの場合は、現在のルールを維持する
+	modTime = modTime.Add(time.Minute)
+	writeRule("10.0.0.0/8\npermit 192.168.0.0/24\n", modTime)
+	if err := filter.reload(); err == nil {
+		t.Errorf("no error for illegal rule file")
+	}
+	filter.reloadIfModified()
+	checkIPFilter(t, filter, map[string]bool{"192.168.0.2": false, "10.0.0.1": true})
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -17,6 +18,9 @@ import (
 
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
 )
 
 // 接続先情報
@@ -55,10 +59,32 @@ type CryptMode struct {
 	work []byte
 	// 暗号化処理
 	stream cipher.Stream
+	// 暗号化の向き。暗号化なら true、複合化なら false
+	isEnc bool
+	// 現在の鍵で処理したサイズ
+	processedSize int64
+	// 現在の鍵を設定した時刻
+	keyTime time.Time
+	// 鍵の更新回数
+	generation int
 }
 type CryptCtrl struct {
 	enc CryptMode
 	dec CryptMode
+	// パスワードから生成した鍵。鍵更新時の元にする。
+	key []byte
+}
+
+// key と iv から CFB の cipher.Stream を生成する
+func newCFBStream(key []byte, iv []byte, isEnc bool) cipher.Stream {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	if isEnc {
+		return cipher.NewCFBEncrypter(block, iv)
+	}
+	return cipher.NewCFBDecrypter(block, iv)
 }
 
 // 暗号用のオブジェクトを生成する
@@ -72,25 +98,56 @@ func CreateCryptCtrl(pass *string, count int) *CryptCtrl {
 
 	bufSize := BUFSIZE
 	key := getKey([]byte(*pass))
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		panic(err)
-	}
 	iv := make([]byte, aes.BlockSize)
 	for index := 0; index < len(iv); index++ {
 		iv[index] = byte(index)
 	}
 
-	encrypter := cipher.NewCFBEncrypter(block, iv)
-	decrypter := cipher.NewCFBDecrypter(block, iv)
+	encrypter := newCFBStream(key, iv, true)
+	decrypter := newCFBStream(key, iv, false)
 
+	now := time.Now()
 	ctrl := CryptCtrl{
-		CryptMode{count, 0, make([]byte, bufSize), encrypter},
-		CryptMode{count, 0, make([]byte, bufSize), decrypter}}
+		CryptMode{count, 0, make([]byte, bufSize), encrypter, true, 0, now, 0},
+		CryptMode{count, 0, make([]byte, bufSize), decrypter, false, 0, now, 0},
+		key}
 
 	return &ctrl
 }
 
+// 鍵を更新する
+//
+// 新しい鍵は、パスワードから生成した鍵と nonce から生成する。
+// 送信側と受信側で同じ nonce を使って更新することで、同じ鍵になる。
+//
+// @param key パスワードから生成した鍵
+// @param nonce 鍵更新用の乱数
+func (mode *CryptMode) rekey(key []byte, nonce []byte) {
+	newKey := sha256.Sum256(append(append([]byte{}, key...), nonce...))
+	iv := sha256.Sum256(newKey[:])
+	mode.stream = newCFBStream(newKey[:], iv[:aes.BlockSize], mode.isEnc)
+	mode.processedSize = 0
+	mode.keyTime = time.Now()
+	mode.generation++
+}
+
+// 鍵の更新が必要かどうか
+//
+// @param size この鍵で処理するサイズの上限。 0 以下の場合は制限なし。
+// @param interval この鍵を使用する時間の上限。 0 以下の場合は制限なし。
+func (mode *CryptMode) needRekey(size int64, interval time.Duration) bool {
+	if !mode.IsValid() {
+		return false
+	}
+	if size > 0 && mode.processedSize >= size {
+		return true
+	}
+	if interval > 0 && time.Now().Sub(mode.keyTime) >= interval {
+		return true
+	}
+	return false
+}
+
 func (mode *CryptMode) IsValid() bool {
 	if mode == nil || mode.countMax == 0 {
 		return false
@@ -112,7 +169,13 @@ func (mode *CryptMode) Process(inbuf []byte, outbuf []byte) []byte {
 		work = mode.work
 	}
 	if len(inbuf) > len(work) {
-		panic(fmt.Errorf("over length"))
+		if outbuf != nil {
+			panic(fmt.Errorf("over length"))
+		}
+		// ネゴシエーションで BUFSIZE より大きいフレームを使う場合は、
+		// 作業用バッファを拡張する
+		mode.work = make([]byte, len(inbuf))
+		work = mode.work
 	}
 	if mode.countMax == 0 {
 		return inbuf
@@ -130,6 +193,7 @@ func (mode *CryptMode) Process(inbuf []byte, outbuf []byte) []byte {
 	// return buf
 
 	mode.stream.XORKeyStream(work, inbuf)
+	mode.processedSize += int64(len(inbuf))
 
 	return work[:len(inbuf)]
 }
@@ -150,16 +214,89 @@ const PACKET_KIND_NORMAL = 0
 // 無通信を避けるためのダミーパケット
 const PACKET_KIND_DUMMY = 1
 
-// packetWriter() の処理終了を通知するためのパケット
+// packetWriter() の処理終了を通知するためのパケット。
+// FEATURE_EOS が有効な場合、セッションを終了する際は相手にも送信する。
 const PACKET_KIND_EOS = 2
 
 // Tunnel の通信を同期するためのパケット
 const PACKET_KIND_SYNC = 3
 const PACKET_KIND_NORMAL_DIRECT = 4
 
+// citi の通信の終了を通知するパケット。
+// データは CLOSE_HOW_* と CLOSE_REASON_* の 2 バイト。
+const PACKET_KIND_CLOSE = 5
+
+// セッションのリセットを通知するパケット。 FEATURE_RESET が有効な場合に送信する。
+// データは理由の文字列長 (uint16) と理由の文字列。
+// 暗号の状態が相手と一致しない場合も読めるように、暗号化しない。
+const PACKET_KIND_RESET = 6
+
+// パケット種別に付けるフラグ。
+// このフラグが付いている場合、種別の後にシーケンス番号 (int64) が続く。
+const PACKET_FLAG_SEQ = 0x40
+
+// シーケンス番号を付けない場合のシーケンス番号
+const NO_SEQ = -1
+
+// 送信側の書き込みだけを終了する。 TCP の half-close に相当する。
+const CLOSE_HOW_WRITE = 1
+
+// 送受信とも中断する。ローカルの接続は RST で切断する。
+const CLOSE_HOW_RESET = 2
+
+// PACKET_KIND_CLOSE のデータサイズ
+const CLOSE_BODY_SIZE = 2
+
+// PACKET_KIND_RESET の理由の最大長
+const RESET_REASON_MAX = 256
+
+// citi の終了理由
+// 正常終了 (EOF)
+const CLOSE_REASON_EOF = 0
+
+// ローカルの接続の読み込みエラー
+const CLOSE_REASON_READ_ERR = 1
+
+// ローカルの接続の書き込みエラー
+const CLOSE_REASON_WRITE_ERR = 2
+
+// 接続先への接続失敗
+const CLOSE_REASON_DIAL_FAILED = 3
+
+// 設定による接続拒否
+const CLOSE_REASON_REJECTED = 4
+
+// 不正なデータを受信した
+const CLOSE_REASON_PROTOCOL = 5
+
+// セッションの終了
+const CLOSE_REASON_SESSION = 6
+
+// 終了理由の文字列表現
+func closeReason2str(reason byte) string {
+	switch reason {
+	case CLOSE_REASON_EOF:
+		return "eof"
+	case CLOSE_REASON_READ_ERR:
+		return "read error"
+	case CLOSE_REASON_WRITE_ERR:
+		return "write error"
+	case CLOSE_REASON_DIAL_FAILED:
+		return "dial failed"
+	case CLOSE_REASON_REJECTED:
+		return "rejected"
+	case CLOSE_REASON_PROTOCOL:
+		return "protocol error"
+	case CLOSE_REASON_SESSION:
+		return "session closed"
+	}
+	return fmt.Sprintf("unknown(%d)", reason)
+}
+
 var dummyKindBuf = []byte{PACKET_KIND_DUMMY}
 var normalKindBuf = []byte{PACKET_KIND_NORMAL}
 var syncKindBuf = []byte{PACKET_KIND_SYNC}
+var closeKindBuf = []byte{PACKET_KIND_CLOSE}
 
 var PACKET_LEN_HEADER int = 0
 
@@ -168,6 +305,55 @@ func init() {
 	PACKET_LEN_HEADER = len(normalKindBuf) + int(unsafe.Sizeof(citiId))
 }
 
+// フレームの形式
+type FrameFormat struct {
+	// データ長を uint32 で表現する場合 true。 false の場合は uint16。
+	wideLen bool
+	// 1 フレームの最大データサイズ
+	maxSize int
+	// SYNC で処理済みのバイト数も通知する場合 true。
+	// false の場合は、パケット番号だけを通知する。
+	byteWindow bool
+	// パケットにシーケンス番号を付ける場合 true
+	seq bool
+}
+
+// 旧バージョンのフレーム形式。
+// 認証処理中は、この形式を使う。
+var legacyFrameFormat = &FrameFormat{false, BUFSIZE, false, false}
+
+// ネゴシエーションした機能から、フレームの形式を取得する
+func newFrameFormat(caps *Capability) *FrameFormat {
+	format := &FrameFormat{
+		false, BUFSIZE, caps.hasFeature(FEATURE_BYTE_WINDOW),
+		caps.hasFeature(FEATURE_SEQ)}
+	if caps.hasFeature(FEATURE_WIDE_LEN) && caps.MaxFrameSize > BUFSIZE {
+		format.wideLen = true
+		format.maxSize = caps.MaxFrameSize
+	}
+	if !format.wideLen && !format.byteWindow && !format.seq {
+		return legacyFrameFormat
+	}
+	return format
+}
+
+// SYNC のデータサイズ
+func (format *FrameFormat) syncSize() int {
+	if format.byteWindow {
+		return SYNC_BYTES_SIZE
+	}
+	var packNo int64
+	return int(unsafe.Sizeof(packNo))
+}
+
+// データ長のヘッダサイズ
+func (format *FrameFormat) lenSize() int {
+	if format.wideLen {
+		return 4
+	}
+	return 2
+}
+
 func WriteDummy(ostream io.Writer) error {
 	if _, err := ostream.Write(dummyKindBuf); err != nil {
 		return err
@@ -175,20 +361,52 @@ func WriteDummy(ostream io.Writer) error {
 	return nil
 }
 
-func WriteSimpleKind(ostream io.Writer, kind int8, citiId uint32, buf []byte) error {
+// パケット種別を出力する
+//
+// フレーム形式がシーケンス番号を付ける形式の場合は、
+// 種別に PACKET_FLAG_SEQ を付けてシーケンス番号を続けて出力する。
+//
+// @param ostream 出力先
+// @param kindbuf パケット種別
+// @param format フレーム形式
+// @param seq シーケンス番号
+func writeKind(ostream io.Writer, kindbuf []byte, format *FrameFormat, seq int64) error {
+	if !format.seq || seq == NO_SEQ {
+		_, err := ostream.Write(kindbuf)
+		return err
+	}
+	if _, err := ostream.Write([]byte{kindbuf[0] | PACKET_FLAG_SEQ}); err != nil {
+		return err
+	}
+	return binary.Write(ostream, binary.BigEndian, seq)
+}
+
+// citiId と固定長のデータだけのパケットを出力する
+//
+// @param format フレーム形式。 nil の場合は旧バージョンの形式。
+// @param seq シーケンス番号。付けない場合は NO_SEQ。
+// @return error kind が SYNC, CLOSE 以外の場合は ErrIllegalMessage をラップしたエラー
+func WriteSimpleKind(
+	ostream io.Writer, kind int8, citiId uint32, buf []byte,
+	format *FrameFormat, seq int64) error {
 
 	var kindbuf []byte
 	switch kind {
 	case PACKET_KIND_SYNC:
 		kindbuf = syncKindBuf
+	case PACKET_KIND_CLOSE:
+		kindbuf = closeKindBuf
 	default:
-		log.Fatal("illegal kind -- ", kind)
+		return fmt.Errorf("%w -- illegal kind %d", ErrIllegalMessage, kind)
+	}
+	if format == nil {
+		format = legacyFrameFormat
 	}
 
 	var buffer bytes.Buffer
 	buffer.Grow(PACKET_LEN_HEADER + len(buf))
 
-	if _, err := buffer.Write(kindbuf); err != nil {
+	if err := writeKind(&buffer, kindbuf, format, seq); err != nil {
 		return err
 	}
 	if err := binary.Write(&buffer, binary.BigEndian, citiId); err != nil {
@@ -202,14 +420,39 @@ func WriteSimpleKind(ostream io.Writer, kind int8, citiId uint32, buf []byte) er
 	return err
 }
 
+// セッションのリセットを通知するパケットを出力する
+//
+// @param reason 理由。 RESET_REASON_MAX を越える分は切り捨てる。
+// @param format フレーム形式
+// @param seq シーケンス番号。付けない場合は NO_SEQ。
+func WriteReset(ostream io.Writer, reason string, format *FrameFormat, seq int64) error {
+	if len(reason) > RESET_REASON_MAX {
+		reason = reason[:RESET_REASON_MAX]
+	}
+	var buffer bytes.Buffer
+	if err := writeKind(&buffer, []byte{PACKET_KIND_RESET}, format, seq); err != nil {
+		return err
+	}
+	if err := binary.Write(&buffer, binary.BigEndian, uint16(len(reason))); err != nil {
+		return err
+	}
+	buffer.WriteString(reason)
+
+	_, err := buffer.WriteTo(ostream)
+	return err
+}
+
 // データを出力する
 //
 // ostream 出力先
 // buf データ
 // ctrl 暗号化情報
+// format フレーム形式。 nil の場合は旧バージョンの形式。
+// seq シーケンス番号。付けない場合は NO_SEQ。
 func WriteItem(
 	ostream io.Writer, citiId uint32,
-	buf []byte, ctrl *CryptCtrl, workBuf *bytes.Buffer) error {
+	buf []byte, ctrl *CryptCtrl, workBuf *bytes.Buffer, format *FrameFormat,
+	seq int64) error {
 	// write のコール数が多いと通信効率が悪いので
 	// 一旦バッファに書き込んでから ostream に出力する。
 	var buffer *bytes.Buffer = workBuf
@@ -218,12 +461,14 @@ func WriteItem(
 	} else {
 		buffer.Reset()
 	}
-	size := uint16(len(buf))
+	if format == nil {
+		format = legacyFrameFormat
+	}
 	buffer.Grow(
 		len(normalKindBuf) + int(unsafe.Sizeof(citiId)) +
-			int(unsafe.Sizeof(size)) + len(buf))
+			format.lenSize() + len(buf))
 
-	if err := WriteItemDirect(buffer, citiId, buf, ctrl); err != nil {
+	if err := WriteItemDirect(buffer, citiId, buf, ctrl, format, seq); err != nil {
 		return err
 	}
 
@@ -236,8 +481,18 @@ func WriteItem(
 // ostream 出力先
 // buf データ
 // ctrl 暗号化情報
-func WriteItemDirect(ostream io.Writer, citiId uint32, buf []byte, ctrl *CryptCtrl) error {
-	if _, err := ostream.Write(normalKindBuf); err != nil {
+// format フレーム形式。 nil の場合は旧バージョンの形式。
+// seq シーケンス番号。付けない場合は NO_SEQ。
+func WriteItemDirect(
+	ostream io.Writer, citiId uint32, buf []byte,
+	ctrl *CryptCtrl, format *FrameFormat, seq int64) error {
+	if format == nil {
+		format = legacyFrameFormat
+	}
+	if len(buf) > format.maxSize {
+		return fmt.Errorf("over frame size -- %d > %d", len(buf), format.maxSize)
+	}
+	if err := writeKind(ostream, normalKindBuf, format, seq); err != nil {
 		return err
 	}
 	if err := binary.Write(ostream, binary.BigEndian, citiId); err != nil {
@@ -246,8 +501,14 @@ func WriteItemDirect(ostream io.Writer, citiId uint32, buf []byte, ctrl *CryptCt
 	if ctrl != nil {
 		buf = ctrl.enc.Process(buf, nil)
 	}
-	if err := binary.Write(ostream, binary.BigEndian, uint16(len(buf))); err != nil {
-		return err
+	if format.wideLen {
+		if err := binary.Write(ostream, binary.BigEndian, uint32(len(buf))); err != nil {
+			return err
+		}
+	} else {
+		if err := binary.Write(ostream, binary.BigEndian, uint16(len(buf))); err != nil {
+			return err
+		}
 	}
 	_, err := ostream.Write(buf)
 	return err
@@ -257,6 +518,8 @@ type PackItem struct {
 	citiId uint32
 	buf    []byte
 	kind   int8
+	// シーケンス番号。付いていない場合は NO_SEQ。
+	seq int64
 }
 
 func ReadCitiId(istream io.Reader) (uint32, error) {
@@ -268,15 +531,19 @@ func ReadCitiId(istream io.Reader) (uint32, error) {
 	return binary.BigEndian.Uint32(buf), nil
 }
 
-func ReadPackNo(istream io.Reader, kind int8) (*PackItem, error) {
+// citiId と固定長のデータだけのパケットを読み込む
+//
+// @param istream 読み込み元ストリーム
+// @param kind PACKET_KIND_*
+// @param size データサイズ
+func ReadSimpleKind(istream io.Reader, kind int8, size int) (*PackItem, error) {
 	var item PackItem
 	item.kind = kind
 	var error error
 	if item.citiId, error = ReadCitiId(istream); error != nil {
 		return nil, error
 	}
-	var packNo int64
-	item.buf = make([]byte, unsafe.Sizeof(packNo))
+	item.buf = make([]byte, size)
 	_, err := io.ReadFull(istream, item.buf)
 	if err != nil {
 		return &item, err
@@ -284,9 +551,13 @@ func ReadPackNo(istream io.Reader, kind int8) (*PackItem, error) {
 	return &item, nil
 }
 
+// 不正なフレームを受信した場合のエラー。
+// 続きのデータの区切りが分からないので、そのセッションは続けられない。
+var ErrIllegalFrame = errors.New("illegal frame")
+
 type CitiBuf interface {
 	// citiId 向けのバッファを取得する
-	GetPacketBuf(citiId uint32, packSize uint16) []byte
+	GetPacketBuf(citiId uint32, packSize int) []byte
 }
 
 type HeapCitiBuf struct {
@@ -294,7 +565,7 @@ type HeapCitiBuf struct {
 
 var heapCitiBuf *HeapCitiBuf = &HeapCitiBuf{}
 
-func (citiBuf *HeapCitiBuf) GetPacketBuf(citiId uint32, packSize uint16) []byte {
+func (citiBuf *HeapCitiBuf) GetPacketBuf(citiId uint32, packSize int) []byte {
 	return make([]byte, packSize)
 }
 
@@ -303,11 +574,17 @@ func (citiBuf *HeapCitiBuf) GetPacketBuf(citiId uint32, packSize uint16) []byte
 // @param istream 読み込み元ストリーム
 // @param ctrl 暗号化制御
 // @param workBuf
+// @param format フレーム形式。 nil の場合は旧バージョンの形式。
 func ReadItem(
 	istream io.Reader, ctrl *CryptCtrl,
-	workBuf []byte, citiBuf CitiBuf) (*PackItem, error) {
+	workBuf []byte, citiBuf CitiBuf, format *FrameFormat) (*PackItem, error) {
+
+	if format == nil {
+		format = legacyFrameFormat
+	}
 
 	var item PackItem
+	item.seq = NO_SEQ
 
 	var kindbuf []byte
 	if workBuf != nil {
@@ -319,20 +596,49 @@ func ReadItem(
 	if error != nil {
 		return nil, error
 	}
-	switch item.kind = int8(kindbuf[0]); item.kind {
-	case PACKET_KIND_DUMMY:
+	kind := kindbuf[0]
+	if kind&PACKET_FLAG_SEQ != 0 {
+		kind &^= PACKET_FLAG_SEQ
+		if error := binary.Read(istream, binary.BigEndian, &item.seq); error != nil {
+			return nil, error
+		}
+	}
+	switch item.kind = int8(kind); item.kind {
+	case PACKET_KIND_DUMMY, PACKET_KIND_EOS:
+		return &item, nil
+	case PACKET_KIND_SYNC, PACKET_KIND_CLOSE:
+		size := CLOSE_BODY_SIZE
+		if item.kind == PACKET_KIND_SYNC {
+			size = format.syncSize()
+		}
+		simpleItem, error := ReadSimpleKind(istream, item.kind, size)
+		if simpleItem != nil {
+			simpleItem.seq = item.seq
+		}
+		return simpleItem, error
+	case PACKET_KIND_RESET:
+		var size uint16
+		if error := binary.Read(istream, binary.BigEndian, &size); error != nil {
+			return nil, error
+		}
+		if size > RESET_REASON_MAX {
+			return nil, fmt.Errorf(
+				"%w -- over reset reason size %d", ErrIllegalFrame, size)
+		}
+		item.buf = make([]byte, size)
+		if _, error := io.ReadFull(istream, item.buf); error != nil {
+			return nil, error
+		}
 		return &item, nil
-	case PACKET_KIND_SYNC:
-		return ReadPackNo(istream, item.kind)
 	case PACKET_KIND_NORMAL:
 		if item.citiId, error = ReadCitiId(istream); error != nil {
 			return nil, error
 		}
 		var buf []byte
 		if workBuf != nil {
-			buf = workBuf[:2]
+			buf = workBuf[:format.lenSize()]
 		} else {
-			buf = make([]byte, 2)
+			buf = make([]byte, format.lenSize())
 		}
 
 		//buf := make([]byte,2)
@@ -340,14 +646,25 @@ func ReadItem(
 		if error != nil {
 			return nil, error
 		}
-		packSize := binary.BigEndian.Uint16(buf)
+		var packSize int
+		if format.wideLen {
+			packSize = int(binary.BigEndian.Uint32(buf))
+		} else {
+			packSize = int(binary.BigEndian.Uint16(buf))
+		}
+		if packSize > format.maxSize {
+			return nil, fmt.Errorf(
+				"%w -- over frame size %d > %d", ErrIllegalFrame, packSize, format.maxSize)
+		}
 		var packBuf []byte
 		var citiPackBuf []byte = nil
 		if workBuf == nil {
 			packBuf = make([]byte, packSize)
 		} else {
-			if len(workBuf) < int(packSize) {
-				log.Fatal("workbuf size is short -- ", len(workBuf))
+			if len(workBuf) < packSize {
+				return nil, fmt.Errorf(
+					"%w -- workbuf size is short %d < %d",
+					ErrIllegalFrame, len(workBuf), packSize)
 			}
 			citiPackBuf = citiBuf.GetPacketBuf(item.citiId, packSize)
 			if ctrl == nil || !ctrl.dec.IsValid() {
@@ -369,13 +686,13 @@ func ReadItem(
 		item.buf = packBuf
 		return &item, nil
 	default:
-		return nil, fmt.Errorf("ReadItem illegal kind -- %d", item.kind)
+		return nil, fmt.Errorf("%w -- ReadItem illegal kind %d", ErrIllegalFrame, item.kind)
 	}
 }
 
 // データを読み込む
 func readItemForNormal(istream io.Reader, ctrl *CryptCtrl) (*PackItem, error) {
-	item, err := ReadItem(istream, ctrl, nil, heapCitiBuf)
+	item, err := ReadItem(istream, ctrl, nil, heapCitiBuf, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -397,11 +714,97 @@ func readItemWithReader(istream io.Reader, ctrl *CryptCtrl) (io.Reader, error) {
 	return bytes.NewReader(item.buf), nil
 }
 
+// 制御メッセージの JSON の最大サイズ
+const CTRL_JSON_SIZE_MAX = 64 * 1024
+
+// 不正な制御メッセージを受信した場合のエラー。
+var ErrIllegalMessage = errors.New("illegal message")
+
+// 相手から受けとった制御メッセージの JSON を読み込む
+//
+// 相手は信頼できないので、サイズが CTRL_JSON_SIZE_MAX を越えるもの、
+// val にないフィールドを含むもの、後ろに余分なデータが続くものはエラーにする。
+// 認証のメッセージも同じなので、フィールドを追加する場合は
+// Capability でネゴシエーションした相手にだけ送ること。
+//
+// @param reader JSON のデータ
+// @param val 格納先
+// @return error 不正な場合 ErrIllegalMessage をラップしたエラー
+func decodeJSON(reader io.Reader, val interface{}) error {
+	buf, err := io.ReadAll(io.LimitReader(reader, CTRL_JSON_SIZE_MAX+1))
+	if err != nil {
+		return err
+	}
+	if len(buf) > CTRL_JSON_SIZE_MAX {
+		return fmt.Errorf(
+			"%w -- over json size %d", ErrIllegalMessage, CTRL_JSON_SIZE_MAX)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(val); err != nil {
+		return fmt.Errorf("%w -- %s", ErrIllegalMessage, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("%w -- trailing data after json", ErrIllegalMessage)
+	}
+	return nil
+}
+
+// 認証前に受け付けるフレーム数。
+// クライアントから認証前に来るのは AuthResponse だけ。
+const PRE_AUTH_FRAME_MAX = 1
+
+// 認証前に受け付けるデータサイズ。
+// ズレ確認のバイト列と、 AuthResponse のフレームが入るサイズ。
+const PRE_AUTH_SIZE_MAX = CTRL_JSON_SIZE_MAX + 1024
+
+// 認証前のコネクションから読み込む量を制限する reader
+//
+// 誰でも接続できる認証前のコネクションで、
+// 大量のデータを送りつけられてリソースを消費しないようにする。
+type preAuthReader struct {
+	stream io.Reader
+	// 読み込んだフレーム数
+	frameNum int
+	// 読み込んだデータサイズ
+	size int
+}
+
+func (reader *preAuthReader) Read(buf []byte) (int, error) {
+	remain := PRE_AUTH_SIZE_MAX - reader.size
+	if remain <= 0 {
+		return 0, fmt.Errorf(
+			"%w -- over pre-auth size %d", ErrIllegalFrame, PRE_AUTH_SIZE_MAX)
+	}
+	if len(buf) > remain {
+		buf = buf[:remain]
+	}
+	size, err := reader.stream.Read(buf)
+	reader.size += size
+	return size, err
+}
+
+// 認証前の制御メッセージを読み込む
+//
+// @param ctrl 暗号情報
+// @return io.Reader 制御メッセージ
+// @return error PRE_AUTH_FRAME_MAX を越えた場合もエラー
+func (reader *preAuthReader) readItem(ctrl *CryptCtrl) (io.Reader, error) {
+	if reader.frameNum >= PRE_AUTH_FRAME_MAX {
+		return nil, fmt.Errorf(
+			"%w -- over pre-auth frame %d", ErrIllegalFrame, PRE_AUTH_FRAME_MAX)
+	}
+	reader.frameNum++
+	return readItemWithReader(reader, ctrl)
+}
+
 // server -> client
 type AuthChallenge struct {
 	Ver       string
 	Challenge string
 	Mode      string
+	// サーバがサポートする機能
+	Caps *Capability
 }
 
 const BENCH_LOOP_COUNT = 200
@@ -418,8 +821,21 @@ type AuthResponse struct {
 	WriteNo      int64
 	ReadNo       int64
 	Ctrl         int
+	// 新規セッション時に、セッションの秘密情報を共有するための公開鍵 (base64)
+	SessionPubKey string
+	// 再接続時に、セッションの秘密情報を持っていることを示す証明 (base64)
+	SessionProof string
+	// クライアントのプロトコルバージョン
+	Ver string
+	// サーバとクライアントで共通の機能
+	Caps *Capability
+	// クライアントが再送できる最も古いパケット番号
+	ResendFrom int64
 }
 
+// セッションを再開できずにリセットした場合の AuthResult.Result
+const AUTH_RESULT_RESET = "reset"
+
 // server -> client
 type AuthResult struct {
 	Result       string
@@ -428,6 +844,12 @@ type AuthResult struct {
 	WriteNo      int64
 	ReadNo       int64
 	ForwardList  []ForwardInfo
+	// 新規セッション時に、セッションの秘密情報を共有するための公開鍵 (base64)
+	SessionPubKey string
+	// このセッションで使用する機能
+	Caps *Capability
+	// サーバが再送できる最も古いパケット番号
+	ResendFrom int64
 }
 
 func generateChallengeResponse(challenge string, pass *string, hint string) string {
@@ -435,6 +857,128 @@ func generateChallengeResponse(challenge string, pass *string, hint string) stri
 	return base64.StdEncoding.EncodeToString(sum[:])
 }
 
+// セッションの秘密情報を共有するための鍵を生成する
+//
+// @return *ecdh.PrivateKey 秘密鍵
+// @return string 相手に送る公開鍵 (base64)
+func generateSessionKey() (*ecdh.PrivateKey, string) {
+	privKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err.Error())
+	}
+	return privKey, base64.StdEncoding.EncodeToString(privKey.PublicKey().Bytes())
+}
+
+// 自分の秘密鍵と相手の公開鍵から、セッションの秘密情報を生成する
+//
+// 秘密情報は通信路に流れないので、
+// 通信を盗聴してもセッションの再接続は出来ない。
+func deriveSessionSecret(privKey *ecdh.PrivateKey, peerPubKey string) ([]byte, error) {
+	bin, err := base64.StdEncoding.DecodeString(peerPubKey)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := ecdh.X25519().NewPublicKey(bin)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := privKey.ECDH(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(append([]byte("kptunnel-session:"), shared...))
+	return sum[:], nil
+}
+
+// 再接続時に、セッションの秘密情報を持っていることを示す証明を生成する
+//
+// challenge を含めるので、過去の証明を使い回すことは出来ない。
+func generateSessionProof(secret []byte, challenge string, hint string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("resume:" + challenge + ":" + hint))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// セッションをリセットしたことを AuthResult で通知する
+func writeAuthResultReset(connInfo *ConnInfo) error {
+	bytes, _ := json.Marshal(AuthResult{Result: AUTH_RESULT_RESET})
+	return WriteItem(
+		connInfo.Conn, CITIID_CTRL, bytes, connInfo.CryptCtrlObj, nil, nil, NO_SEQ)
+}
+
+// 認証失敗の AuthResult を返す
+func writeAuthResultNg(connInfo *ConnInfo, mess string) error {
+	result := "ng"
+	if mess != "" {
+		result = "ng: " + mess
+	}
+	bytes, _ := json.Marshal(AuthResult{Result: result})
+	return WriteItem(
+		connInfo.Conn, CITIID_CTRL, bytes, connInfo.CryptCtrlObj, nil, nil, NO_SEQ)
+}
+
+// 期限を設定できるコネクション
+type deadlineSetter interface {
+	SetDeadline(t time.Time) error
+}
+
+// コネクションの読み書きの期限を設定する
+//
+// @param conn コネクション。期限を設定できない場合は何もしない。
+// @param timeout 期限までの時間。 0 以下の場合は期限を解除する。
+func setConnDeadline(conn io.ReadWriteCloser, timeout time.Duration) {
+	setter, ok := conn.(deadlineSetter)
+	if !ok {
+		return
+	}
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := setter.SetDeadline(deadline); err != nil {
+		log.Printf("failed to set deadline -- %s", err)
+	}
+}
+
+// 読み込みと書き込みの期限を個別に設定できるコネクション
+type readDeadlineSetter interface {
+	SetReadDeadline(t time.Time) error
+}
+type writeDeadlineSetter interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// 期限までの時間から期限の時刻を求める。 0 以下の場合は期限なし。
+func timeout2deadline(timeout time.Duration) time.Time {
+	if timeout > 0 {
+		return time.Now().Add(timeout)
+	}
+	return time.Time{}
+}
+
+// コネクションの読み込みの期限を設定する
+//
+// 通信ごとに呼ばれるので、失敗してもログは出さない。
+// 閉じたコネクションなどで失敗した場合は、続く読み込みがエラーになる。
+//
+// @param conn コネクション。期限を設定できない場合は何もしない。
+// @param timeout 期限までの時間。 0 以下の場合は期限を解除する。
+func setConnReadDeadline(conn io.ReadWriteCloser, timeout time.Duration) {
+	if setter, ok := conn.(readDeadlineSetter); ok {
+		setter.SetReadDeadline(timeout2deadline(timeout))
+	}
+}
+
+// コネクションの書き込みの期限を設定する
+//
+// @param conn コネクション。期限を設定できない場合は何もしない。
+// @param timeout 期限までの時間。 0 以下の場合は期限を解除する。
+func setConnWriteDeadline(conn io.ReadWriteCloser, timeout time.Duration) {
+	if setter, ok := conn.(writeDeadlineSetter); ok {
+		setter.SetWriteDeadline(timeout2deadline(timeout))
+	}
+}
+
 // サーバ側のネゴシエーション処理
 //
 // 接続しに来たクライアントの認証を行なう。
@@ -448,110 +992,217 @@ func ProcessServerAuth(
 	connInfo *ConnInfo, param *TunnelParam,
 	remoteAddr string, forwardList []ForwardInfo) (bool, error) {
 
+	// 認証前のコネクションでリソースを占有されないように、
+	// 同時に処理するハンドシェイク数と、ハンドシェイクの時間を制限する。
+	if err := BeginHandshake(param); err != nil {
+		return false, err
+	}
+	defer EndHandshake()
+
 	stream := connInfo.Conn
+	setConnDeadline(stream, param.authTimeout)
+	defer setConnDeadline(stream, 0)
 	log.Print("start auth")
 
 	if err := CorrectLackOffsetWrite(stream); err != nil {
 		return false, err
 	}
-	if err := CorrectLackOffsetRead(stream); err != nil {
+	// 認証前は、読み込むフレーム数とサイズを制限する
+	preAuth := &preAuthReader{stream, 0, 0}
+	if err := CorrectLackOffsetRead(preAuth); err != nil {
 		return false, err
 	}
 
 	// 共通文字列を暗号化して送信することで、
 	// 接続先の暗号パスワードが一致しているかチェック出来るようにデータ送信
-	WriteItem(stream, CITIID_CTRL, []byte(param.magic), connInfo.CryptCtrlObj, nil)
+	WriteItem(
+		stream, CITIID_CTRL, []byte(param.magic), connInfo.CryptCtrlObj, nil, nil,
+		NO_SEQ)
 
 	// challenge 文字列生成
 	nano := time.Now().UnixNano()
-	sum := sha256.Sum256([]byte(fmt.Sprint("%v", nano)))
+	sum := sha256.Sum256([]byte(fmt.Sprint(nano)))
 	str := base64.StdEncoding.EncodeToString(sum[:])
-	challenge := AuthChallenge{"1.00", str, param.Mode}
+	challenge := AuthChallenge{PROTOCOL_VER, str, param.Mode, localCapability(param)}
 
 	bytes, _ := json.Marshal(challenge)
 	if err := WriteItem(
-		stream, CITIID_CTRL, bytes, connInfo.CryptCtrlObj, nil); err != nil {
+		stream, CITIID_CTRL, bytes, connInfo.CryptCtrlObj, nil, nil, NO_SEQ); err != nil {
 		return false, err
 	}
 	log.Print("challenge ", challenge.Challenge)
 	connInfo.SessionInfo.SetState(Session_state_authchallenge)
 
 	// challenge-response 処理
-	reader, err := readItemWithReader(stream, connInfo.CryptCtrlObj)
+	reader, err := preAuth.readItem(connInfo.CryptCtrlObj)
 	if err != nil {
 		return false, err
 	}
 	var resp AuthResponse
-	if err := json.NewDecoder(reader).Decode(&resp); err != nil {
+	if err := decodeJSON(reader, &resp); err != nil {
 		return false, err
 	}
 	if resp.Response != generateChallengeResponse(
 		challenge.Challenge, param.pass, resp.Hint) {
 		// challenge-response が不一致なので、認証失敗
-		bytes, _ := json.Marshal(AuthResult{"ng", 0, "", 0, 0, nil})
-		if err := WriteItem(
-			stream, CITIID_CTRL, bytes, connInfo.CryptCtrlObj, nil); err != nil {
+		if err := writeAuthResultNg(connInfo, ""); err != nil {
 			return false, err
 		}
 		log.Print("mismatch password")
+		NotifyAuthResult(remoteAddr, false, param)
 		return false, fmt.Errorf("mismatch password")
 	}
 
+	NotifyAuthResult(remoteAddr, true, param)
+
 	// ここまででクライアントの認証が成功したので、
 	// これ以降はクライアントが通知してきた情報を受けいれて OK
 
+	// プロトコルバージョンを確認し、クライアントが通知してきた機能から
+	// サーバがサポートしている機能だけを取り出す。
+	peerCaps, err := peerCapability(param, resp.Ver, resp.Caps)
+	var caps *Capability
+	if err == nil {
+		caps, err = negotiateCapability(challenge.Caps, peerCaps)
+	}
+	if err != nil {
+		log.Print(err)
+		writeAuthResultNg(connInfo, err.Error())
+		return false, err
+	}
+
 	// クライアントが送ってきた sessionId を取り入れる
 	sessionToken := resp.SessionToken
 	newSession := false
+	serverPubKey := ""
 	if sessionToken == "" {
 		// sessionId が "" なら、新規セッション
+		var secret []byte
+		if resp.SessionPubKey == "" && isLegacyProtocol(resp.Ver) {
+			// 鍵交換をサポートしていない旧バージョンのクライアントは、
+			// 秘密情報なしで受け付ける。このセッションは再接続できない。
+			log.Print("legacy client -- session resume is disabled")
+		} else if resp.SessionPubKey == "" {
+			// 秘密情報を共有できないセッションは再接続できないので受け付けない
+			mess := "no session key"
+			if err := writeAuthResultNg(connInfo, mess); err != nil {
+				return false, err
+			}
+			return false, fmt.Errorf("%s", mess)
+		} else {
+			privKey, pubKey := generateSessionKey()
+			secret, err = deriveSessionSecret(privKey, resp.SessionPubKey)
+			if err != nil {
+				writeAuthResultNg(connInfo, "illegal session key")
+				return false, err
+			}
+			serverPubKey = pubKey
+		}
 		connInfo.SessionInfo = NewSessionInfo(true)
+		connInfo.SessionInfo.sessionSecret = secret
+		connInfo.SessionInfo.setCaps(caps)
+		connInfo.SessionInfo.setupCrypt(param)
 		newSession = true
 	} else {
-		if sessionInfo, has := GetSessionInfo(sessionToken); !has {
-			mess := fmt.Sprintf("not found session -- %d", sessionToken)
-			bytes, _ := json.Marshal(AuthResult{"ng: " + mess, 0, "", 0, 0, nil})
-			if err := WriteItem(
-				stream, CITIID_CTRL, bytes, connInfo.CryptCtrlObj, nil); err != nil {
+		sessionInfo, has := GetSessionInfo(sessionToken)
+		if has && !sessionInfo.canResume() {
+			// 再接続できないセッションなので、新しいセッションを開始してもらう。
+			// token だけでは再接続させない。
+			log.Printf("resume is disabled -- %d", sessionInfo.SessionId)
+			if err := writeAuthResultReset(connInfo); err != nil {
+				return false, err
+			}
+			return false, fmt.Errorf("resume is disabled -- %d", sessionInfo.SessionId)
+		}
+		if has && !hmac.Equal(
+			[]byte(resp.SessionProof),
+			[]byte(generateSessionProof(
+				sessionInfo.sessionSecret, challenge.Challenge, resp.Hint))) {
+			// token を知っていても、秘密情報を持っていなければ再接続させない
+			log.Printf("mismatch session proof -- %d", sessionInfo.SessionId)
+			has = false
+		}
+		if !has && isExpiredSession(sessionToken) {
+			// 破棄したセッションなので、新しいセッションを開始してもらう。
+			// 正規のクライアントの再接続なので、認証失敗には数えない。
+			log.Print("resume the expired session")
+			if err := writeAuthResultReset(connInfo); err != nil {
 				return false, err
 			}
-			return false, fmt.Errorf(mess)
+			return false, fmt.Errorf("expired session")
+		} else if !has {
+			// token はログに残さない
+			NotifyAuthResult(remoteAddr, false, param)
+			mess := "not found session"
+			if err := writeAuthResultNg(connInfo, mess); err != nil {
+				return false, err
+			}
+			return false, fmt.Errorf("%s", mess)
+		} else if sessionInfo.isReset() {
+			// リセットしたセッションなので、新しいセッションを開始してもらう
+			log.Printf("resume the reset session -- %d", sessionInfo.SessionId)
+			if err := writeAuthResultReset(connInfo); err != nil {
+				return false, err
+			}
+			return false, fmt.Errorf("reset session -- %d", sessionInfo.SessionId)
 		} else {
+			// 再接続時は、セッション開始時に確定した機能を使い続ける
 			connInfo.SessionInfo = sessionInfo
 			WaitPauseSession(connInfo.SessionInfo)
 		}
 	}
+	log.Printf("capability -- %s", connInfo.SessionInfo.caps)
 	log.Printf(
-		"sessionId: %s, ReadNo: %d(%d), WriteNo: %d(%d)",
-		sessionToken, connInfo.SessionInfo.ReadNo, resp.WriteNo,
+		"sessionId: %d, ReadNo: %d(%d), WriteNo: %d(%d)",
+		connInfo.SessionInfo.SessionId, connInfo.SessionInfo.ReadNo, resp.WriteNo,
 		connInfo.SessionInfo.WriteNo, resp.ReadNo)
+	if err := connInfo.SessionInfo.checkResume(
+		resp.ReadNo, resp.WriteNo, resp.ResendFrom); err != nil {
+		// 再送できないパケットがあるので、このセッションは再開できない
+		log.Printf("session desync -- %d, %s", connInfo.SessionInfo.SessionId, err)
+		connInfo.SessionInfo.reset(err.Error())
+		if err := writeAuthResultReset(connInfo); err != nil {
+			return false, err
+		}
+		return false, err
+	}
+
+	// サーバが forward を指定している場合は、その設定で PROXY protocol のヘッダを送る。
+	// クライアントの設定は信用しない。
+	connInfo.SessionInfo.forwardList = forwardList
 
 	// AuthResult を返す
 	bytes, _ = json.Marshal(
 		AuthResult{
 			"ok", connInfo.SessionInfo.SessionId, connInfo.SessionInfo.SessionToken,
-			connInfo.SessionInfo.WriteNo, connInfo.SessionInfo.ReadNo, forwardList})
-	log.Printf("forwardList -- %s", forwardList)
+			connInfo.SessionInfo.WriteNo, connInfo.SessionInfo.ReadNo, forwardList,
+			serverPubKey, connInfo.SessionInfo.caps,
+			connInfo.SessionInfo.resendFrom()})
+	log.Printf("forwardList -- %v", forwardList)
 	if err := WriteItem(
-		stream, CITIID_CTRL, bytes, connInfo.CryptCtrlObj, nil); err != nil {
+		stream, CITIID_CTRL, bytes, connInfo.CryptCtrlObj, nil, nil, NO_SEQ); err != nil {
 		return false, err
 	}
 	log.Print("match password")
 	connInfo.SessionInfo.SetState(Session_state_authresult)
 
 	// データ再送のための設定
-	connInfo.SessionInfo.SetReWrite(resp.ReadNo)
+	if err := connInfo.SessionInfo.SetReWrite(resp.ReadNo); err != nil {
+		connInfo.SessionInfo.reset(err.Error())
+		return false, err
+	}
 
 	if resp.Ctrl == CTRL_BENCH {
 		// ベンチマーク
 		benchBuf := make([]byte, 100)
 		for count := 0; count < BENCH_LOOP_COUNT; count++ {
 			if _, err := ReadItem(
-				stream, connInfo.CryptCtrlObj, benchBuf, heapCitiBuf); err != nil {
+				stream, connInfo.CryptCtrlObj, benchBuf, heapCitiBuf, nil); err != nil {
 				return false, err
 			}
 			if err := WriteItem(
-				stream, CITIID_CTRL, benchBuf, connInfo.CryptCtrlObj, nil); err != nil {
+				stream, CITIID_CTRL, benchBuf, connInfo.CryptCtrlObj, nil, nil,
+				NO_SEQ); err != nil {
 				return false, err
 			}
 		}
@@ -640,6 +1291,8 @@ func ProcessClientAuth(
 	log.Print("start auth")
 
 	stream := connInfo.Conn
+	setConnDeadline(stream, param.authTimeout)
+	defer setConnDeadline(stream, 0)
 
 	if err := CorrectLackOffsetRead(stream); err != nil {
 		return nil, true, err
@@ -664,7 +1317,7 @@ func ProcessClientAuth(
 		return nil, true, err
 	}
 	var challenge AuthChallenge
-	if err := json.NewDecoder(reader).Decode(&challenge); err != nil {
+	if err := decodeJSON(reader, &challenge); err != nil {
 		return nil, true, err
 	}
 	log.Print("challenge ", challenge.Challenge)
@@ -688,18 +1341,45 @@ func ProcessClientAuth(
 		}
 	}
 
+	// プロトコルバージョンを確認し、サーバと共通の機能を取り出す
+	peerCaps, err := peerCapability(param, challenge.Ver, challenge.Caps)
+	if err != nil {
+		return nil, false, err
+	}
+	caps, err := negotiateCapability(localCapability(param), peerCaps)
+	if err != nil {
+		return nil, false, err
+	}
+
 	// response を生成
 	nano := time.Now().UnixNano()
-	sum := sha256.Sum256([]byte(fmt.Sprint("%v", nano)))
+	sum := sha256.Sum256([]byte(fmt.Sprint(nano)))
 	hint := base64.StdEncoding.EncodeToString(sum[:])
 	resp := generateChallengeResponse(challenge.Challenge, param.pass, hint)
+
+	// 新規セッションなら秘密情報共有用の鍵を、
+	// 再接続なら秘密情報を持っていることの証明を送る
+	// 旧バージョンのサーバは鍵交換をサポートしていないので送らない
+	legacyServer := isLegacyProtocol(challenge.Ver)
+	var privKey *ecdh.PrivateKey
+	pubKey := ""
+	proof := ""
+	if connInfo.SessionInfo.SessionToken == "" {
+		if !legacyServer {
+			privKey, pubKey = generateSessionKey()
+		}
+	} else {
+		proof = generateSessionProof(
+			connInfo.SessionInfo.sessionSecret, challenge.Challenge, hint)
+	}
 	bytes, _ := json.Marshal(
 		AuthResponse{
 			resp, hint, connInfo.SessionInfo.SessionToken,
 			connInfo.SessionInfo.WriteNo,
-			connInfo.SessionInfo.ReadNo, param.ctrl})
+			connInfo.SessionInfo.ReadNo, param.ctrl, pubKey, proof,
+			PROTOCOL_VER, caps, connInfo.SessionInfo.resendFrom()})
 	if err := WriteItem(
-		stream, CITIID_CTRL, bytes, connInfo.CryptCtrlObj, nil); err != nil {
+		stream, CITIID_CTRL, bytes, connInfo.CryptCtrlObj, nil, nil, NO_SEQ); err != nil {
 		return nil, true, err
 	}
 	connInfo.SessionInfo.SetState(Session_state_authresponse)
@@ -712,14 +1392,24 @@ func ProcessClientAuth(
 		if err != nil {
 			return nil, true, err
 		}
-		if err := json.NewDecoder(reader).Decode(&result); err != nil {
+		if err := decodeJSON(reader, &result); err != nil {
 			return nil, true, err
 		}
+		if result.Result == AUTH_RESULT_RESET {
+			// サーバ側でセッションを再開できなかったので、こちらもリセットする
+			connInfo.SessionInfo.reset("reset by the server")
+			return nil, false, fmt.Errorf(
+				"session is reset -- %d", connInfo.SessionInfo.SessionId)
+		}
 		if result.Result != "ok" {
 			return nil, false, fmt.Errorf("failed to auth -- %s", result.Result)
 		}
+		// サーバが確定した機能を使う
+		if caps, err = resultCapability(caps, result.Caps); err != nil {
+			return nil, false, err
+		}
 
-		log.Printf("forwardList -- %s", result.ForwardList)
+		log.Printf("forwardList -- %v", result.ForwardList)
 		if forwardList != nil &&
 			result.ForwardList != nil && len(result.ForwardList) > 0 {
 			// クライアントが指定している ForwardList と、
@@ -755,11 +1445,12 @@ func ProcessClientAuth(
 			prev := time.Now()
 			for count := 0; count < BENCH_LOOP_COUNT; count++ {
 				if err := WriteItem(
-					stream, CITIID_CTRL, benchBuf, connInfo.CryptCtrlObj, nil); err != nil {
+					stream, CITIID_CTRL, benchBuf, connInfo.CryptCtrlObj, nil, nil,
+					NO_SEQ); err != nil {
 					return nil, false, err
 				}
 				if _, err := ReadItem(
-					stream, connInfo.CryptCtrlObj, benchBuf, heapCitiBuf); err != nil {
+					stream, connInfo.CryptCtrlObj, benchBuf, heapCitiBuf, nil); err != nil {
 					return nil, false, err
 				}
 			}
@@ -772,8 +1463,22 @@ func ProcessClientAuth(
 			if connInfo.SessionInfo.SessionId == 0 {
 				// 新規接続だった場合、セッション情報を更新する
 				//connInfo.SessionInfo.SessionId = result.SessionId
+				var secret []byte
+				if legacyServer {
+					// 秘密情報を共有できないので、このセッションは再接続できない
+					log.Print("legacy server -- session resume is disabled")
+				} else {
+					if privKey == nil {
+						return nil, false, fmt.Errorf("illegal session key")
+					}
+					secret, err = deriveSessionSecret(privKey, result.SessionPubKey)
+					if err != nil {
+						return nil, false, err
+					}
+				}
 				connInfo.SessionInfo.UpdateSessionId(
-					result.SessionId, result.SessionToken)
+					result.SessionId, result.SessionToken, secret, caps)
+				connInfo.SessionInfo.setupCrypt(param)
 			} else {
 				return nil, false, fmt.Errorf(
 					"illegal sessionId -- %d, %d",
@@ -785,8 +1490,20 @@ func ProcessClientAuth(
 			"sessionId: %d, ReadNo: %d(%d), WriteNo: %d(%d)",
 			result.SessionId, connInfo.SessionInfo.ReadNo, result.WriteNo,
 			connInfo.SessionInfo.WriteNo, result.ReadNo)
-		connInfo.SessionInfo.SetReWrite(result.ReadNo)
+		log.Printf("capability -- %s", connInfo.SessionInfo.caps)
+		if err := connInfo.SessionInfo.checkResume(
+			result.ReadNo, result.WriteNo, result.ResendFrom); err != nil {
+			// 再開できないセッションなので、リセットして再接続を諦める
+			connInfo.SessionInfo.reset(err.Error())
+			return nil, false, err
+		}
+		if err := connInfo.SessionInfo.SetReWrite(result.ReadNo); err != nil {
+			connInfo.SessionInfo.reset(err.Error())
+			return nil, false, err
+		}
 	}
 
+	// reverse の場合は、 forward を指定しているサーバの設定で PROXY protocol のヘッダを送る
+	connInfo.SessionInfo.forwardList = result.ForwardList
 	return result.ForwardList, true, nil
 }
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 旧バージョンの AuthChallenge
+type legacyAuthChallenge struct {
+	Ver       string
+	Challenge string
+	Mode      string
+}
+
+// 旧バージョンの AuthResponse
+type legacyAuthResponse struct {
+	Response     string
+	Hint         string
+	SessionToken string
+	WriteNo      int64
+	ReadNo       int64
+	Ctrl         int
+}
+
+// 旧バージョンの AuthResult
+type legacyAuthResult struct {
+	Result       string
+	SessionId    int
+	SessionToken string
+	WriteNo      int64
+	ReadNo       int64
+	ForwardList  []ForwardInfo
+}
+
+// 旧バージョンの形式 (kind, citiId, uint16 のデータ長) でフレームを書き込む
+func writeLegacyFrame(t *testing.T, stream io.Writer, val interface{}) {
+	t.Helper()
+	var body []byte
+	switch val := val.(type) {
+	case []byte:
+		body = val
+	default:
+		body, _ = json.Marshal(val)
+	}
+	buf := make([]byte, 7, 7+len(body))
+	buf[0] = PACKET_KIND_NORMAL
+	binary.BigEndian.PutUint32(buf[1:], CITIID_CTRL)
+	binary.BigEndian.PutUint16(buf[5:], uint16(len(body)))
+	if _, err := stream.Write(append(buf, body...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 旧バージョンの形式のフレームを読み込む
+func readLegacyFrame(t *testing.T, stream io.Reader) []byte {
+	t.Helper()
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != PACKET_KIND_NORMAL {
+		t.Fatalf("illegal kind -- %d", header[0])
+	}
+	if citiId := binary.BigEndian.Uint32(header[1:]); citiId != CITIID_CTRL {
+		t.Fatalf("illegal citiId -- %d", citiId)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[5:]))
+	if _, err := io.ReadFull(stream, body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// ズレ確認のバイト列を読み書きする
+func exchangeLackOffset(t *testing.T, stream io.ReadWriter, readFirst bool) {
+	t.Helper()
+	offsetBytes := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	read := func() {
+		buf := make([]byte, len(offsetBytes))
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if readFirst {
+		read()
+	}
+	if _, err := stream.Write(offsetBytes); err != nil {
+		t.Fatal(err)
+	}
+	if !readFirst {
+		read()
+	}
+}
+
+func newTestParam(mode string) *TunnelParam {
+	pass := "testpass"
+	return &TunnelParam{
+		pass:              &pass,
+		Mode:              mode,
+		keepAliveInterval: KEEP_ALIVE_INTERVAL,
+		magic:             []byte(pass),
+		authTimeout:       10 * time.Second,
+		maxFrameSize:      BUFSIZE,
+		window:            PACKET_NUM * BUFSIZE,
+	}
+}
+
+// 旧バージョンのクライアントが、新しいサーバに接続できることを確認する
+func TestLegacyClientHandshake(t *testing.T) {
+	param := newTestParam("server")
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	connInfo := CreateConnInfo(serverConn, nil, 0, nil, true)
+	type authRet struct {
+		newSession bool
+		err        error
+	}
+	retChan := make(chan authRet, 1)
+	go func() {
+		newSession, err := ProcessServerAuth(
+			connInfo, param, "127.0.0.1:10000", nil)
+		retChan <- authRet{newSession, err}
+	}()
+
+	// 旧バージョンのクライアントの処理
+	clientConn.SetDeadline(time.Now().Add(10 * time.Second))
+	exchangeLackOffset(t, clientConn, true)
+	if magic := readLegacyFrame(t, clientConn); string(magic) != string(param.magic) {
+		t.Fatalf("unmatch magic -- %s", magic)
+	}
+	var challenge legacyAuthChallenge
+	if err := json.Unmarshal(readLegacyFrame(t, clientConn), &challenge); err != nil {
+		t.Fatal(err)
+	}
+	hint := "hint"
+	writeLegacyFrame(t, clientConn, legacyAuthResponse{
+		generateChallengeResponse(challenge.Challenge, param.pass, hint), hint,
+		"", 0, 0, CTRL_NONE})
+	var result legacyAuthResult
+	if err := json.Unmarshal(readLegacyFrame(t, clientConn), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	ret := <-retChan
+	if ret.err != nil {
+		t.Fatalf("auth error -- %s", ret.err)
+	}
+	if result.Result != "ok" || !ret.newSession {
+		t.Fatalf("auth result -- %s, %v", result.Result, ret.newSession)
+	}
+	sessionInfo := connInfo.SessionInfo
+	if sessionInfo.frameFormat != legacyFrameFormat {
+		t.Errorf("frame format is not legacy -- %v", sessionInfo.frameFormat)
+	}
+	if len(sessionInfo.caps.Features) != 0 || sessionInfo.caps.KeepAlive != 0 {
+		t.Errorf("capability is not legacy -- %s", sessionInfo.caps)
+	}
+	if sessionInfo.canResume() {
+		t.Errorf("legacy session can resume")
+	}
+}
+
+// 新しいクライアントが、旧バージョンのサーバに接続できることを確認する
+func TestLegacyServerHandshake(t *testing.T) {
+	param := newTestParam("client")
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	connInfo := CreateConnInfo(clientConn, nil, 0, nil, false)
+	type authRet struct {
+		err error
+	}
+	retChan := make(chan authRet, 1)
+	go func() {
+		_, _, err := ProcessClientAuth(connInfo, param, nil)
+		retChan <- authRet{err}
+	}()
+
+	// 旧バージョンのサーバの処理
+	serverConn.SetDeadline(time.Now().Add(10 * time.Second))
+	exchangeLackOffset(t, serverConn, false)
+	writeLegacyFrame(t, serverConn, param.magic)
+	challenge := legacyAuthChallenge{PROTOCOL_VER_LEGACY, "challenge", "server"}
+	writeLegacyFrame(t, serverConn, challenge)
+	var resp legacyAuthResponse
+	if err := json.Unmarshal(readLegacyFrame(t, serverConn), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Response != generateChallengeResponse(
+		challenge.Challenge, param.pass, resp.Hint) {
+		t.Fatal("mismatch response")
+	}
+	writeLegacyFrame(t, serverConn, legacyAuthResult{"ok", 1, "token", 0, 0, nil})
+
+	ret := <-retChan
+	if ret.err != nil {
+		t.Fatalf("auth error -- %s", ret.err)
+	}
+	sessionInfo := connInfo.SessionInfo
+	if sessionInfo.SessionId != 1 {
+		t.Errorf("illegal sessionId -- %d", sessionInfo.SessionId)
+	}
+	if sessionInfo.frameFormat != legacyFrameFormat {
+		t.Errorf("frame format is not legacy -- %v", sessionInfo.frameFormat)
+	}
+	if sessionInfo.caps.KeepAlive != 0 {
+		t.Errorf("keep alive is negotiated with legacy server -- %s", sessionInfo.caps)
+	}
+	if sessionInfo.canResume() {
+		t.Errorf("legacy session can resume")
+	}
+}
+
+// テスト中のログを抑止する
+func discardLog(tb testing.TB) {
+	tb.Helper()
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// 相手の機能とネゴシエーションした結果が、 local の範囲内か確認する
+func checkNegotiatedCaps(t *testing.T, local *Capability, caps *Capability) {
+	t.Helper()
+	if len(caps.Ciphers) != 1 || len(intersectStrList(caps.Ciphers, local.Ciphers)) != 1 {
+		t.Errorf("illegal cipher -- %v, %v", caps.Ciphers, local.Ciphers)
+	}
+	if caps.MaxFrameSize <= 0 || caps.MaxFrameSize > local.MaxFrameSize {
+		t.Errorf("illegal frame size -- %d, %d", caps.MaxFrameSize, local.MaxFrameSize)
+	}
+	if format := newFrameFormat(caps); format.maxSize > local.MaxFrameSize {
+		t.Errorf("illegal frame format -- %d, %d", format.maxSize, local.MaxFrameSize)
+	}
+	if caps.Window < MIN_WINDOW || caps.Window > local.Window {
+		t.Errorf("illegal window -- %d, %d", caps.Window, local.Window)
+	}
+	if caps.KeepAlive != 0 && caps.KeepAlive < KEEP_ALIVE_INTERVAL_MIN {
+		t.Errorf("illegal keep alive -- %d", caps.KeepAlive)
+	}
+	if len(intersectStrList(caps.Features, local.Features)) != len(caps.Features) {
+		t.Errorf("illegal features -- %v, %v", caps.Features, local.Features)
+	}
+	if len(intersectStrList(caps.Compress, local.Compress)) != len(caps.Compress) {
+		t.Errorf("illegal compress -- %v, %v", caps.Compress, local.Compress)
+	}
+}
+
+// 受信した JSON を decodeJSON() で読み込み、サイズの上限を確認する
+func decodeFuzzJSON(t *testing.T, data []byte, val interface{}) bool {
+	t.Helper()
+	err := decodeJSON(bytes.NewReader(data), val)
+	if err == nil && len(data) > CTRL_JSON_SIZE_MAX {
+		t.Fatalf("over json size is accepted -- %d", len(data))
+	}
+	if err != nil && !errors.Is(err, ErrIllegalMessage) {
+		t.Fatalf("illegal error -- %s", err)
+	}
+	return err == nil
+}
+
+// フレームの種類ごとのシードを生成する
+func readItemSeeds(f *testing.F) {
+	wideFormat := &FrameFormat{true, BUFSIZE * 2, true, true}
+	formats := []*FrameFormat{legacyFrameFormat, wideFormat}
+	for _, format := range formats {
+		var buffer bytes.Buffer
+		WriteItem(&buffer, CITIID_CTRL, []byte(`{"Result":"ok"}`), nil, nil, format, NO_SEQ)
+		WriteItem(&buffer, CITIID_USR, make([]byte, 100), nil, nil, format, 1)
+		WriteSimpleKind(
+			&buffer, PACKET_KIND_SYNC, CITIID_USR, make([]byte, format.syncSize()),
+			format, 2)
+		WriteSimpleKind(
+			&buffer, PACKET_KIND_CLOSE, CITIID_USR,
+			[]byte{CLOSE_HOW_RESET, CLOSE_REASON_EOF}, format, NO_SEQ)
+		WriteDummy(&buffer)
+		writeKind(&buffer, []byte{byte(PACKET_KIND_EOS)}, format, 3)
+		WriteReset(&buffer, "not found packet -- 4", format, 4)
+		f.Add(buffer.Bytes(), format.wideLen, format.byteWindow, format.seq)
+	}
+	// データ長がフレームの最大サイズを越える
+	f.Add([]byte{PACKET_KIND_NORMAL, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}, true, false, false)
+	// 不正な kind
+	f.Add([]byte{0x3f, 0, 0, 0, 0}, false, false, false)
+	// データが途中で切れている
+	f.Add([]byte{PACKET_KIND_NORMAL, 0, 0, 0, 0, 0, 10, 1, 2}, false, false, false)
+}
+
+// 不正なフレームを読み込んでも、フレーム形式の範囲内で処理することを確認する
+func FuzzReadItem(f *testing.F) {
+	readItemSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte, wideLen bool, byteWindow bool, seq bool) {
+		format := &FrameFormat{false, BUFSIZE, byteWindow, seq}
+		if wideLen {
+			format = &FrameFormat{true, BUFSIZE * 2, byteWindow, seq}
+		}
+		workBufList := [][]byte{nil, make([]byte, format.maxSize)}
+		for _, workBuf := range workBufList {
+			reader := bytes.NewReader(data)
+			for {
+				item, err := ReadItem(reader, nil, workBuf, heapCitiBuf, format)
+				if err != nil {
+					break
+				}
+				switch item.kind {
+				case PACKET_KIND_NORMAL:
+					if len(item.buf) > format.maxSize {
+						t.Fatalf("over frame size -- %d", len(item.buf))
+					}
+				case PACKET_KIND_SYNC:
+					if len(item.buf) != format.syncSize() {
+						t.Fatalf("illegal sync size -- %d", len(item.buf))
+					}
+				case PACKET_KIND_CLOSE:
+					if len(item.buf) != CLOSE_BODY_SIZE {
+						t.Fatalf("illegal close size -- %d", len(item.buf))
+					}
+				case PACKET_KIND_RESET:
+					if len(item.buf) > RESET_REASON_MAX {
+						t.Fatalf("over reset reason size -- %d", len(item.buf))
+					}
+				case PACKET_KIND_DUMMY, PACKET_KIND_EOS:
+				default:
+					t.Fatalf("illegal kind -- %d", item.kind)
+				}
+			}
+		}
+	})
+}
+
+// セッションのリセットの通知を、理由とシーケンス番号付きで読み込めることを確認する
+func TestReset(t *testing.T) {
+	format := &FrameFormat{false, BUFSIZE, true, true}
+	longReason := strings.Repeat("a", RESET_REASON_MAX+1)
+	testList := []struct {
+		reason string
+		expect string
+	}{
+		{"not found packet -- 10", "not found packet -- 10"},
+		{"", ""},
+		{longReason, longReason[:RESET_REASON_MAX]},
+	}
+	for _, test := range testList {
+		var buffer bytes.Buffer
+		if err := WriteReset(&buffer, test.reason, format, 10); err != nil {
+			t.Fatal(err)
+		}
+		item, err := ReadItem(&buffer, nil, nil, heapCitiBuf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.kind != PACKET_KIND_RESET || item.seq != 10 {
+			t.Errorf("unmatch item -- %d, %d", item.kind, item.seq)
+		}
+		if string(item.buf) != test.expect {
+			t.Errorf("unmatch reason -- %q, %q", item.buf, test.expect)
+		}
+	}
+
+	// 理由が長すぎるフレームは不正
+	data := []byte{PACKET_KIND_RESET, 0xff, 0xff}
+	_, err := ReadItem(bytes.NewReader(data), nil, nil, heapCitiBuf, legacyFrameFormat)
+	if !errors.Is(err, ErrIllegalFrame) {
+		t.Errorf("over reason size is accepted -- %v", err)
+	}
+}
+
+// 認証メッセージのシードを追加する
+func addAuthSeeds(f *testing.F, vals ...interface{}) {
+	for _, val := range vals {
+		data, _ := json.Marshal(val)
+		f.Add(data)
+	}
+	// 未知のフィールド
+	f.Add([]byte(`{"Ver":"1.20","Caps":{"Ciphers":["none"],"Future":1},"Future":"x"}`))
+	f.Add([]byte(`{"Caps":{"MaxFrameSize":-1,"Window":2147483647,"KeepAlive":1}}`))
+	f.Add([]byte(`{"Ver":"2.00"}`))
+	f.Add([]byte(`{"Ver":"1.10"} {}`))
+	f.Add([]byte(`{"Hint":"` + strings.Repeat("a", CTRL_JSON_SIZE_MAX) + `"}`))
+	f.Add([]byte(`null`))
+}
+
+// 不正な AuthChallenge を受けても、ネゴシエーションした機能が自分の範囲内になることを確認する
+func FuzzDecodeAuthChallenge(f *testing.F) {
+	param := newTestParam("client")
+	serverParam := newTestParam("server")
+	serverParam.maxFrameSize = MAX_FRAME_SIZE
+	addAuthSeeds(f,
+		AuthChallenge{PROTOCOL_VER, "challenge", "server", localCapability(serverParam)},
+		legacyAuthChallenge{PROTOCOL_VER_LEGACY, "challenge", "server"})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		discardLog(t)
+		var challenge AuthChallenge
+		if !decodeFuzzJSON(t, data, &challenge) {
+			return
+		}
+		peerCaps, err := peerCapability(param, challenge.Ver, challenge.Caps)
+		if err != nil {
+			return
+		}
+		local := localCapability(param)
+		caps, err := negotiateCapability(local, peerCaps)
+		if err != nil {
+			return
+		}
+		checkNegotiatedCaps(t, local, caps)
+	})
+}
+
+// 不正な AuthResponse を受けても、ネゴシエーションした機能がサーバの範囲内になることを確認する
+func FuzzDecodeAuthResponse(f *testing.F) {
+	param := newTestParam("server")
+	_, pubKey := generateSessionKey()
+	addAuthSeeds(f,
+		AuthResponse{
+			"response", "hint", "", 0, 0, CTRL_NONE, pubKey, "", PROTOCOL_VER,
+			localCapability(param), 0},
+		AuthResponse{
+			"response", "hint", "token", 10, 5, CTRL_NONE, "", "proof", PROTOCOL_VER,
+			localCapability(param), 1},
+		legacyAuthResponse{"response", "hint", "", 0, 0, CTRL_NONE})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		discardLog(t)
+		var resp AuthResponse
+		if !decodeFuzzJSON(t, data, &resp) {
+			return
+		}
+		if resp.SessionPubKey != "" {
+			privKey, _ := generateSessionKey()
+			if secret, err := deriveSessionSecret(
+				privKey, resp.SessionPubKey); err == nil && len(secret) == 0 {
+				t.Fatal("empty session secret")
+			}
+		}
+		peerCaps, err := peerCapability(param, resp.Ver, resp.Caps)
+		if err != nil {
+			return
+		}
+		local := localCapability(param)
+		caps, err := negotiateCapability(local, peerCaps)
+		if err != nil {
+			return
+		}
+		checkNegotiatedCaps(t, local, caps)
+	})
+}
+
+// 不正な AuthResult を受けても、クライアントが通知した機能の範囲内になることを確認する
+func FuzzDecodeAuthResult(f *testing.F) {
+	param := newTestParam("client")
+	caps, _ := negotiateCapability(
+		localCapability(param), localCapability(newTestParam("server")))
+	addAuthSeeds(f,
+		AuthResult{"ok", 1, "token", 0, 0, nil, "", caps, 0},
+		AuthResult{
+			"ok", 1, "token", 0, 0,
+			[]ForwardInfo{{
+				HostInfo{"", "", 10000, ""}, HostInfo{"", "localhost", 80, ""},
+				0, "", 0}},
+			"", &Capability{[]string{"none"}, nil, MAX_FRAME_SIZE * 1024,
+				MAX_FRAME_SIZE * 1024, 1, []string{FEATURE_WIDE_LEN}}, 0},
+		AuthResult{AUTH_RESULT_RESET, 0, "", 0, 0, nil, "", nil, 0},
+		legacyAuthResult{"ok", 1, "token", 0, 0, nil})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		discardLog(t)
+		var result AuthResult
+		if !decodeFuzzJSON(t, data, &result) {
+			return
+		}
+		for _, forwardInfo := range result.ForwardList {
+			forwardInfo.Src.toStr()
+			forwardInfo.Dst.toStr()
+		}
+		sessionCaps, err := resultCapability(caps, result.Caps)
+		if err != nil {
+			return
+		}
+		checkNegotiatedCaps(t, caps, sessionCaps)
+	})
+}
+
+// 認証メッセージを含む制御メッセージは、未知のフィールドをエラーにすることを確認する
+func TestDecodeJSONUnknownFields(t *testing.T) {
+	testList := []struct {
+		data string
+		val  interface{}
+	}{
+		{`{"CitiId":1,"Future":1}`, &CtrlRespHeader{}},
+		{`{"Challenge":"x","Future":1}`, &AuthChallenge{}},
+		{`{"Response":"x","Future":1}`, &AuthResponse{}},
+		{`{"Result":"ok","Future":1}`, &AuthResult{}},
+		{`{"Result":"ok","Caps":{"Ciphers":["none"],"Future":1}}`, &AuthResult{}},
+	}
+	for _, test := range testList {
+		err := decodeJSON(strings.NewReader(test.data), test.val)
+		if !errors.Is(err, ErrIllegalMessage) {
+			t.Errorf("unknown field is accepted -- %s, %v", test.data, err)
+		}
+	}
+	var result AuthResult
+	data := `{"Result":"ok","Caps":{"Ciphers":["none"]}}`
+	if err := decodeJSON(strings.NewReader(data), &result); err != nil {
+		t.Errorf("known field is rejected -- %s", err)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 圧縮方式
+const COMPRESS_NONE = "none"
+const COMPRESS_DEFLATE = "deflate"
+const COMPRESS_ZSTD = "zstd"
+
+// サポートしている圧縮方式
+var supportedCompressList = []string{COMPRESS_ZSTD, COMPRESS_DEFLATE}
+
+// 圧縮する citi のパケットの先頭に付ける、データの形式
+const COMP_ID_RAW = 0
+const COMP_ID_DEFLATE = 1
+const COMP_ID_ZSTD = 2
+
+// 圧縮する citi のパケットのヘッダサイズ
+const COMP_HEADER_SIZE = 1
+
+// 圧縮できないデータが続いた場合に、圧縮せずに送るパケット数
+const COMP_SKIP_COUNT = 16
+
+// zstd の encoder/decoder は並行して使えるので、プロセスで共有する
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+
+func setupZstd() {
+	zstdOnce.Do(func() {
+		var err error
+		zstdEncoder, err = zstd.NewWriter(
+			nil, zstd.WithEncoderLevel(zstd.SpeedFastest),
+			zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			panic(err.Error())
+		}
+		// 展開後のサイズがフレームの最大サイズを越えるデータは展開しない
+		zstdDecoder, err = zstd.NewReader(
+			nil, zstd.WithDecoderMaxMemory(MAX_FRAME_SIZE),
+			zstd.WithDecoderConcurrency(0))
+		if err != nil {
+			panic(err.Error())
+		}
+	})
+}
+
+// citi のパケットの圧縮・展開処理
+//
+// 圧縮は tunnel に書き込む前に、パケット単位で行なう。
+// パケット間で辞書を共有しないので、再送時もそのまま送り直せる。
+type CitiCompressor struct {
+	// 圧縮方式 COMPRESS_*
+	name string
+	// COMP_ID_*
+	id byte
+	// このサイズ未満のパケットは圧縮しない
+	minSize int
+	// 1 フレームの最大サイズ。展開後のサイズの上限。
+	maxSize int
+	// 圧縮せずに送るパケットの残り数
+	skip int
+
+	// 圧縮用の作業バッファ
+	work        []byte
+	workBuffer  bytes.Buffer
+	flateWriter *flate.Writer
+	// 展開用の作業バッファ
+	decompBuf   []byte
+	flateReader io.ReadCloser
+	srcReader   bytes.Reader
+}
+
+// citi の圧縮処理を生成する
+//
+// @param name 圧縮方式。 "" の場合は圧縮しない。
+// @param minSize このサイズ未満のパケットは圧縮しない
+// @param maxSize 1 フレームの最大サイズ
+// @return *CitiCompressor 圧縮しない場合は nil
+func NewCitiCompressor(name string, minSize int, maxSize int) (*CitiCompressor, error) {
+	comp := &CitiCompressor{
+		name: name, minSize: minSize, maxSize: maxSize,
+		decompBuf: make([]byte, maxSize+1)}
+	switch name {
+	case "", COMPRESS_NONE:
+		return nil, nil
+	case COMPRESS_DEFLATE:
+		comp.id = COMP_ID_DEFLATE
+		writer, err := flate.NewWriter(&comp.workBuffer, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		comp.flateWriter = writer
+		comp.flateReader = flate.NewReader(&comp.srcReader)
+	case COMPRESS_ZSTD:
+		comp.id = COMP_ID_ZSTD
+		setupZstd()
+	default:
+		return nil, fmt.Errorf("unknown compress -- %s", name)
+	}
+	return comp, nil
+}
+
+// citi で使用する圧縮方式を決定する
+//
+// @param forwardComp forward に指定された圧縮方式
+// @param sessionComp セッション全体に指定された圧縮方式
+// @param caps ネゴシエーションで確定した機能
+// @return string 圧縮方式。圧縮しない場合は ""。
+func selectCompress(forwardComp string, sessionComp string, caps *Capability) string {
+	comp := sessionComp
+	if forwardComp != "" {
+		comp = forwardComp
+	}
+	if comp == "" || comp == COMPRESS_NONE {
+		return ""
+	}
+	if caps != nil {
+		for _, item := range caps.Compress {
+			if item == comp {
+				return comp
+			}
+		}
+	}
+	log.Printf("compress is not supported by the peer -- %s", comp)
+	return ""
+}
+
+// 圧縮方式が正しいか確認する
+func checkCompressName(name string) error {
+	switch name {
+	case "", COMPRESS_NONE, COMPRESS_DEFLATE, COMPRESS_ZSTD:
+		return nil
+	}
+	return fmt.Errorf("unknown compress -- %s", name)
+}
+
+// パケットを圧縮する
+//
+// buf の COMP_HEADER_SIZE 以降に size 分のデータが入っている状態で呼び出す。
+// 圧縮後のデータは buf に上書きする。
+// 圧縮してもサイズが小さくならない場合は、圧縮せずにそのまま返す。
+//
+// @param buf パケットのバッファ
+// @param size データサイズ
+// @return []byte 送信するパケット
+func (comp *CitiCompressor) compress(buf []byte, size int) []byte {
+	data := buf[COMP_HEADER_SIZE : COMP_HEADER_SIZE+size]
+	buf[0] = COMP_ID_RAW
+	if size < comp.minSize {
+		return buf[:COMP_HEADER_SIZE+size]
+	}
+	if comp.skip > 0 {
+		// 圧縮できないデータが続いているので、しばらく圧縮を試みない
+		comp.skip--
+		return buf[:COMP_HEADER_SIZE+size]
+	}
+
+	var compressed []byte
+	switch comp.id {
+	case COMP_ID_DEFLATE:
+		comp.workBuffer.Reset()
+		comp.flateWriter.Reset(&comp.workBuffer)
+		if _, err := comp.flateWriter.Write(data); err != nil {
+			log.Printf("failed to compress -- %s", err)
+			return buf[:COMP_HEADER_SIZE+size]
+		}
+		if err := comp.flateWriter.Close(); err != nil {
+			log.Printf("failed to compress -- %s", err)
+			return buf[:COMP_HEADER_SIZE+size]
+		}
+		compressed = comp.workBuffer.Bytes()
+	case COMP_ID_ZSTD:
+		compressed = zstdEncoder.EncodeAll(data, comp.work[:0])
+		comp.work = compressed
+	}
+
+	if len(compressed) >= size {
+		// 圧縮できないデータ (圧縮済みデータ、暗号化済みデータ) は、
+		// 圧縮しても無駄なので、一定数のパケットの圧縮をスキップする
+		comp.skip = COMP_SKIP_COUNT
+		return buf[:COMP_HEADER_SIZE+size]
+	}
+	buf[0] = comp.id
+	copy(buf[COMP_HEADER_SIZE:], compressed)
+	return buf[:COMP_HEADER_SIZE+len(compressed)]
+}
+
+// パケットを展開する
+//
+// @param buf 受信したパケット
+// @return []byte 展開したデータ。次の展開処理を呼ぶまで有効。
+// @return error 不正なデータの場合
+func (comp *CitiCompressor) decompress(buf []byte) ([]byte, error) {
+	if len(buf) < COMP_HEADER_SIZE {
+		return nil, fmt.Errorf("illegal compressed packet")
+	}
+	data := buf[COMP_HEADER_SIZE:]
+	switch buf[0] {
+	case COMP_ID_RAW:
+		return data, nil
+	case COMP_ID_DEFLATE:
+		if comp.flateReader == nil {
+			comp.flateReader = flate.NewReader(&comp.srcReader)
+		}
+		comp.srcReader.Reset(data)
+		if err := comp.flateReader.(flate.Resetter).Reset(
+			&comp.srcReader, nil); err != nil {
+			return nil, err
+		}
+		return comp.readAllLimit(comp.flateReader)
+	case COMP_ID_ZSTD:
+		setupZstd()
+		decompressed, err := zstdDecoder.DecodeAll(data, comp.decompBuf[:0])
+		if err != nil {
+			return nil, err
+		}
+		if len(decompressed) > comp.maxSize {
+			return nil, fmt.Errorf("over frame size -- %d", len(decompressed))
+		}
+		return decompressed, nil
+	}
+	return nil, fmt.Errorf("unknown compressed id -- %d", buf[0])
+}
+
+// reader から最大 maxSize まで読み込む
+//
+// 展開後のサイズが maxSize を越える場合はエラーにする。
+func (comp *CitiCompressor) readAllLimit(reader io.Reader) ([]byte, error) {
+	buf := comp.decompBuf[:comp.maxSize+1]
+	total := 0
+	for total < len(buf) {
+		size, err := reader.Read(buf[total:])
+		total += size
+		if err == io.EOF {
+			return buf[:total], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("over frame size -- %d", total)
+}
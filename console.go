@@ -47,6 +47,9 @@ var cmdList = []CMD{}
 
 func init() {
 	cmdList = append(cmdList, CMD{"info", "print information", printInformation})
+	cmdList = append(cmdList, CMD{"ban", "print locked out client ip", printBanList})
+	cmdList = append(cmdList, CMD{"reconnect", "print reconnect events", printReconnectEvents})
+	cmdList = append(cmdList, CMD{"drain", "print drain progress", printDrain})
 	cmdList = append(cmdList, CMD{"chat", "start chat", startChat})
 	cmdList = append(cmdList, CMD{"help", "print help", printHelp})
 	cmdList = append(cmdList, CMD{"exit", "eixt console", exitConsole})
@@ -56,6 +59,18 @@ func printInformation(args []string, scanner *bufio.Scanner, ostream io.Writer)
 	DumpSession(ostream)
 	return true
 }
+func printBanList(args []string, scanner *bufio.Scanner, ostream io.Writer) bool {
+	DumpBanList(ostream)
+	return true
+}
+func printReconnectEvents(args []string, scanner *bufio.Scanner, ostream io.Writer) bool {
+	DumpReconnectEvents(ostream)
+	return true
+}
+func printDrain(args []string, scanner *bufio.Scanner, ostream io.Writer) bool {
+	DumpDrain(ostream)
+	return true
+}
 func startChat(args []string, scanner *bufio.Scanner, ostream io.Writer) bool {
 	return true
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// バイト単位のフロー制御を行なう場合の SYNC のデータサイズ。
+// 受信側が処理したバイト数 (int64) とパケット数 (int64)。
+const SYNC_BYTES_SIZE = 16
+
+// フロー制御のウィンドウの最小サイズ (byte)
+const MIN_WINDOW = 4 * BUFSIZE
+
+// citi のリングバッファの最大パケット数
+const MAX_RING_NUM = 1024
+
+// 相手が処理していないパケット数の上限の最小値
+const MIN_INFLIGHT_NUM = 2
+
+// リングバッファに残す余裕のパケット数
+const RING_MARGIN_NUM = 2
+
+// 受信側は、ウィンドウの 1/SYNC_DIV を処理するごとに SYNC を返す
+const SYNC_DIV = 4
+
+// ウィンドウから citi のリングバッファのパケット数を求める
+//
+// リングバッファの 1 パケットはフレームの最大サイズなので、
+// 大きいフレームでもメモリを使い過ぎないように、ウィンドウのバイト数から決める。
+// 最大サイズのフレームでウィンドウを埋めるパケット数に、余裕の分を加える。
+//
+// @param window ウィンドウサイズ (byte)
+// @param frameSize 1 フレームの最大サイズ
+func window2RingNum(window int, frameSize int) int {
+	inflight := window / frameSize
+	if inflight < MIN_INFLIGHT_NUM {
+		inflight = MIN_INFLIGHT_NUM
+	}
+	if inflight > MAX_RING_NUM-RING_MARGIN_NUM {
+		inflight = MAX_RING_NUM - RING_MARGIN_NUM
+	}
+	return inflight + RING_MARGIN_NUM
+}
+
+// リングバッファのパケット数から、相手が処理していないパケット数の上限を求める
+//
+// 送信側は、相手が処理していないパケットのバッファを上書きしないように、
+// 受信側は、 tunnel2Stream() が処理中のバッファを上書きしないように、
+// リングバッファに余裕を残す。
+func ringNum2InflightMax(ringNum int) int64 {
+	return int64(ringNum - RING_MARGIN_NUM)
+}
+
+// citi の送信側のバイト単位のフロー制御
+//
+// 相手が処理していないデータが、ウィンドウサイズと
+// リングバッファのパケット数を越えないように送信を制限する。
+type FlowCtrl struct {
+	mutex sync.Mutex
+	// ネゴシエーションで確定したウィンドウサイズ
+	maxWindow int64
+	// 現在のウィンドウサイズ
+	window int64
+	// 相手が処理していないパケット数の上限
+	inflightMax int64
+	// RTT と転送量からウィンドウサイズを調整する場合 true
+	auto bool
+
+	// 送信したバイト数とパケット数
+	sentBytes int64
+	sentNo    int64
+	// 相手が処理したバイト数とパケット数
+	ackedBytes int64
+	ackedNo    int64
+
+	// RTT 測定中の場合 true
+	sampling bool
+	// RTT 測定対象のデータを送信した時点の sentBytes
+	sampleBytes int64
+	// RTT 測定対象のデータを送信した時刻
+	sampleTime time.Time
+	// 平滑化した RTT
+	srtt time.Duration
+	// 転送量の測定開始時刻と、その時点の ackedBytes
+	rateTime  time.Time
+	rateBytes int64
+}
+
+// フロー制御を生成する
+//
+// @param window ネゴシエーションで確定したウィンドウサイズ
+// @param inflightMax 相手が処理していないパケット数の上限
+// @param auto ウィンドウサイズを自動調整する場合 true
+func NewFlowCtrl(window int64, inflightMax int64, auto bool) *FlowCtrl {
+	flow := &FlowCtrl{
+		maxWindow:   window,
+		window:      window,
+		inflightMax: inflightMax,
+		auto:        auto,
+		rateTime:    time.Now(),
+	}
+	if auto {
+		// 自動調整する場合は、最小サイズから広げていく
+		flow.window = MIN_WINDOW
+	}
+	return flow
+}
+
+// 送信できるかどうか
+func (flow *FlowCtrl) canSend() bool {
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+
+	return flow.sentBytes-flow.ackedBytes < flow.window &&
+		flow.sentNo-flow.ackedNo < flow.inflightMax
+}
+
+// 送信したデータを登録する
+func (flow *FlowCtrl) onSend(size int) {
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+
+	flow.sentBytes += int64(size)
+	flow.sentNo++
+	if !flow.sampling {
+		flow.sampling = true
+		flow.sampleBytes = flow.sentBytes
+		flow.sampleTime = time.Now()
+	}
+}
+
+// 相手から SYNC で通知された処理済みのデータを登録する
+//
+// @param ackedBytes 相手が処理したバイト数
+// @param ackedNo 相手が処理したパケット数
+func (flow *FlowCtrl) onAck(ackedBytes int64, ackedNo int64) {
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+
+	if ackedBytes < flow.ackedBytes || ackedNo < flow.ackedNo {
+		// 古い SYNC は無視する
+		return
+	}
+	flow.ackedBytes = ackedBytes
+	flow.ackedNo = ackedNo
+
+	now := time.Now()
+	if flow.sampling && ackedBytes >= flow.sampleBytes {
+		rtt := now.Sub(flow.sampleTime)
+		if flow.srtt == 0 {
+			flow.srtt = rtt
+		} else {
+			flow.srtt = (flow.srtt*7 + rtt) / 8
+		}
+		flow.sampling = false
+	}
+
+	if flow.auto && flow.srtt > 0 {
+		elapsed := now.Sub(flow.rateTime)
+		if elapsed >= flow.srtt {
+			// 帯域幅と RTT の積の 2 倍をウィンドウサイズにする。
+			// ウィンドウで転送量が制限されている間は、 RTT ごとに倍になる。
+			rate := float64(ackedBytes-flow.rateBytes) / elapsed.Seconds()
+			window := int64(rate * flow.srtt.Seconds() * 2)
+			if window < MIN_WINDOW {
+				window = MIN_WINDOW
+			}
+			if window > flow.maxWindow {
+				window = flow.maxWindow
+			}
+			flow.window = window
+			flow.rateTime = now
+			flow.rateBytes = ackedBytes
+		}
+	}
+}
+
+// フロー制御の状態の文字列表現
+func (flow *FlowCtrl) String() string {
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+
+	return fmt.Sprintf(
+		"window %d/%d, inflight %d bytes %d packets, rtt %s",
+		flow.window, flow.maxWindow, flow.sentBytes-flow.ackedBytes,
+		flow.sentNo-flow.ackedNo, flow.srtt)
+}
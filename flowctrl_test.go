@@ -0,0 +1,172 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// ウィンドウのバイト数と、パケット数の上限で送信を制限することを確認する
+func TestFlowCtrlLimit(t *testing.T) {
+	flow := NewFlowCtrl(MIN_WINDOW, 8, false)
+	sent := 0
+	for flow.canSend() {
+		flow.onSend(BUFSIZE)
+		sent++
+	}
+	if sent != MIN_WINDOW/BUFSIZE {
+		t.Errorf("unmatch sent packets by window -- %d", sent)
+	}
+	flow.onAck(BUFSIZE, 1)
+	if !flow.canSend() {
+		t.Errorf("can't send after ack -- %s", flow)
+	}
+
+	flow = NewFlowCtrl(MIN_WINDOW, 4, false)
+	sent = 0
+	for flow.canSend() {
+		flow.onSend(10)
+		sent++
+	}
+	if sent != 4 {
+		t.Errorf("unmatch sent packets by inflight -- %d", sent)
+	}
+	flow.onAck(10, 1)
+	if !flow.canSend() {
+		t.Errorf("can't send after ack -- %s", flow)
+	}
+}
+
+// 古い SYNC を無視することを確認する
+func TestFlowCtrlStaleAck(t *testing.T) {
+	flow := NewFlowCtrl(MIN_WINDOW, 8, false)
+	for count := 0; count < 4; count++ {
+		flow.onSend(1000)
+	}
+	flow.onAck(2000, 2)
+	flow.onAck(1000, 3)
+	flow.onAck(3000, 1)
+	if flow.ackedBytes != 2000 || flow.ackedNo != 2 {
+		t.Errorf("stale ack is accepted -- %d, %d", flow.ackedBytes, flow.ackedNo)
+	}
+	flow.onAck(3000, 3)
+	if flow.ackedBytes != 3000 || flow.ackedNo != 3 {
+		t.Errorf("ack is ignored -- %d, %d", flow.ackedBytes, flow.ackedNo)
+	}
+}
+
+// RTT の間に ackedBytes だけ処理された状態で、 SYNC を受けてウィンドウを調整する
+func ackAfterRtt(flow *FlowCtrl, rtt time.Duration, ackedBytes int64) {
+	flow.srtt = rtt
+	flow.sampling = false
+	flow.rateTime = time.Now().Add(-rtt)
+	flow.onAck(ackedBytes, flow.ackedNo+1)
+}
+
+// ウィンドウで転送量が制限されている間は、ウィンドウを広げることを確認する
+func TestFlowCtrlAutoWindow(t *testing.T) {
+	maxWindow := int64(MIN_WINDOW * 16)
+	flow := NewFlowCtrl(maxWindow, MAX_RING_NUM, true)
+	if flow.window != MIN_WINDOW {
+		t.Fatalf("initial window is not min -- %d", flow.window)
+	}
+
+	rtt := 100 * time.Millisecond
+	acked := int64(0)
+	prev := flow.window
+	for flow.window < maxWindow {
+		// RTT ごとにウィンドウ分を転送できている
+		acked += flow.window
+		ackAfterRtt(flow, rtt, acked)
+		if flow.window <= prev {
+			t.Fatalf("window doesn't grow -- %d, %d", prev, flow.window)
+		}
+		if flow.window > prev*2 {
+			t.Fatalf("window grows too much -- %d, %d", prev, flow.window)
+		}
+		prev = flow.window
+	}
+	if flow.window != maxWindow {
+		t.Errorf("window is not clamped to max -- %d", flow.window)
+	}
+
+	// 転送量が少なくなったら、最小サイズまで狭める
+	ackAfterRtt(flow, rtt, acked+1)
+	if flow.window != MIN_WINDOW {
+		t.Errorf("window is not clamped to min -- %d", flow.window)
+	}
+}
+
+// 自動調整しない場合は、ウィンドウを変えないことを確認する
+func TestFlowCtrlFixedWindow(t *testing.T) {
+	flow := NewFlowCtrl(MIN_WINDOW*2, MAX_RING_NUM, false)
+	ackAfterRtt(flow, 100*time.Millisecond, MIN_WINDOW*100)
+	if flow.window != MIN_WINDOW*2 {
+		t.Errorf("fixed window is changed -- %d", flow.window)
+	}
+}
+
+func TestWindow2RingNum(t *testing.T) {
+	testList := []struct {
+		window    int
+		frameSize int
+		ringNum   int
+	}{
+		{PACKET_NUM * BUFSIZE, BUFSIZE, PACKET_NUM + RING_MARGIN_NUM},
+		{MIN_WINDOW, BUFSIZE, MIN_WINDOW/BUFSIZE + RING_MARGIN_NUM},
+		{BUFSIZE, BUFSIZE, MIN_INFLIGHT_NUM + RING_MARGIN_NUM},
+		{1, BUFSIZE, MIN_INFLIGHT_NUM + RING_MARGIN_NUM},
+		{BUFSIZE * 1024 * 1024, BUFSIZE, MAX_RING_NUM},
+		// 大きいフレームでは、同じウィンドウでもパケット数が少なくなる
+		{16 * MAX_FRAME_SIZE, MAX_FRAME_SIZE, 16 + RING_MARGIN_NUM},
+		{PACKET_NUM * BUFSIZE, MAX_FRAME_SIZE, PACKET_NUM*BUFSIZE/MAX_FRAME_SIZE + RING_MARGIN_NUM},
+		{MIN_WINDOW, MAX_FRAME_SIZE, MIN_INFLIGHT_NUM + RING_MARGIN_NUM},
+	}
+	for _, test := range testList {
+		ringNum := window2RingNum(test.window, test.frameSize)
+		if ringNum != test.ringNum {
+			t.Errorf(
+				"unmatch ringNum -- %d, %d: %d, %d",
+				test.window, test.frameSize, ringNum, test.ringNum)
+		}
+		inflightMax := ringNum2InflightMax(ringNum)
+		if inflightMax < MIN_INFLIGHT_NUM || inflightMax != int64(ringNum-RING_MARGIN_NUM) {
+			t.Errorf("illegal inflightMax -- %d, %d", ringNum, inflightMax)
+		}
+	}
+}
+
+func TestNeedSync(t *testing.T) {
+	sessionInfo := newEmptySessionInfo(0, "", true)
+	sessionInfo.caps = &Capability{Window: PACKET_NUM * BUFSIZE}
+	sessionInfo.ringNum = window2RingNum(sessionInfo.caps.Window, BUFSIZE)
+	citi := NewConnInTunnelInfo(nil, CITIID_USR, BUFSIZE, sessionInfo.ringNum)
+
+	if sessionInfo.needSync(citi) {
+		t.Errorf("sync without read")
+	}
+	// ウィンドウの 1/SYNC_DIV を処理した
+	citi.ReadNo, citi.ReadSize = 1, int64(sessionInfo.caps.Window/SYNC_DIV)
+	if !sessionInfo.needSync(citi) {
+		t.Errorf("no sync by size")
+	}
+	// パケット数の上限の 1/SYNC_DIV を処理した
+	citi.ReadNo = ringNum2InflightMax(sessionInfo.ringNum) / SYNC_DIV
+	citi.ReadSize = 1
+	if !sessionInfo.needSync(citi) {
+		t.Errorf("no sync by packet num")
+	}
+	// 少量でも、受信待ちのパケットがなければ返す
+	citi.ReadNo, citi.ReadSize = 1, MIN_WINDOW/SYNC_DIV
+	if !sessionInfo.needSync(citi) {
+		t.Errorf("no sync when idle")
+	}
+	citi.readPackChan <- make([]byte, 1)
+	if sessionInfo.needSync(citi) {
+		t.Errorf("sync with pending packets")
+	}
+	// SYNC で通知済み
+	citi.syncedNo, citi.syncedSize = citi.ReadNo, citi.ReadSize
+	if sessionInfo.needSync(citi) {
+		t.Errorf("sync after synced")
+	}
+}
@@ -0,0 +1,11 @@
+module github.com/hgsgtk/kptunnel
+
+go 1.25.0
+
+require (
+	github.com/elazarl/goproxy v1.9.2
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/net v0.57.0
+)
+
+require golang.org/x/text v0.40.0 // indirect
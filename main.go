@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"os/signal"
 	"strconv"
 	"strings"
 	"time"
@@ -18,9 +17,13 @@ import (
 const VERSION = "0.0.1"
 
 // 2byte の MAX。
-// ここを 65535 より大きくする場合は、WriteItem, ReadItem の処理を変更する。
+// 旧バージョンのフレームのデータ長は uint16 なので、これが 1 フレームの最大サイズ。
+// これより大きいフレームは、ネゴシエーションで FEATURE_WIDE_LEN が有効な場合だけ使う。
 const BUFSIZE = 65535
 
+// ネゴシエーションで使用できる 1 フレームの最大サイズ
+const MAX_FRAME_SIZE = 1024 * 1024
+
 func hostname2HostInfo(name string) *HostInfo {
 	if strings.Index(name, "://") == -1 {
 		name = fmt.Sprintf("http://%s", name)
@@ -53,7 +56,7 @@ func IsVerbose() bool {
 func main() {
 
 	if BUFSIZE >= 65536 {
-		fmt.Printf("BUFSIZE is illegal. -- ", 65536)
+		fmt.Printf("BUFSIZE is illegal. -- %d\n", BUFSIZE)
 	}
 
 	var cmd = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
@@ -134,8 +137,74 @@ func ParseOpt(
  -1: infinity
   0: plain
   N: packet count`)
-	ipPattern := cmd.String("ip", "", "allow ip range (192.168.0.1/24)")
+	rekeySize := cmd.Int(
+		"rekeySize", 0, "rotate the encryption key after sending N MB. (0: disable)")
+	rekeyTime := cmd.Int(
+		"rekeyTime", 0, "rotate the encryption key after N seconds. (0: disable)")
+	ipPattern := cmd.String(
+		"ip", "",
+		"allow/deny ip range list. '!' means deny. (192.168.0.1/24,!10.0.0.0/8)")
+	ipFile := cmd.String(
+		"ipFile", "",
+		"allow/deny ip range file. reloaded when modified or on SIGHUP.")
+	trustProxy := cmd.String(
+		"trustProxy", "",
+		"trusted proxy ip range list. the client ip is taken from X-Forwarded-For, Forwarded or PROXY protocol. (10.0.0.0/8,127.0.0.1)")
+	proxyProtocol := cmd.Bool(
+		"proxyProtocol", false, "accept PROXY protocol v1/v2 from the trusted proxy")
+	authTimeout := cmd.Int("authTimeout", 30, "timeout seconds of the authentication")
+	maxHandshake := cmd.Int(
+		"maxHandshake", 32, "max count of the concurrent authentications. (0: unlimited)")
+	maxSession := cmd.Int(
+		"maxSession", MAX_SESSION_PER_CLIENT, "max session count per client ip")
+	rate := cmd.Float64(
+		"rate", 0, "max new handshake count per second for all clients. (0: unlimited)")
+	rateIP := cmd.Float64(
+		"rateIP", 0, "max new handshake count per second per client ip. (0: unlimited)")
+	lockout := cmd.Int(
+		"lockout", 10,
+		fmt.Sprintf(
+			"lockout seconds after %d auth failures. doubled on each failure. (0: disable)",
+			AUTH_FAIL_THRESHOLD))
 	interval := cmd.Int("int", 20, "keep alive interval")
+	deadCount := cmd.Int(
+		"deadCount", 3,
+		"reconnect when nothing is received for this count of keep alive intervals. (0: disable)")
+	compress := cmd.String(
+		"compress", "", "compress the tunnel data. (deflate, zstd)")
+	compMin := cmd.Int(
+		"compMin", 256, "min packet size to compress")
+	dialTimeout := cmd.Int(
+		"dialTimeout", 10, "timeout seconds to connect to the forward target. (0: OS default)")
+	reconnectMode := cmd.String(
+		"reconnectMode", RECONNECT_MODE_QUEUE,
+		"new connection while reconnecting the tunnel. (queue: wait, reject: reject)")
+	frameSize := cmd.Int(
+		"frameSize", BUFSIZE,
+		fmt.Sprintf("max frame size. (%d - %d)", BUFSIZE, MAX_FRAME_SIZE))
+	window := cmd.Int(
+		"window", 4096,
+		fmt.Sprintf("flow control window KB per connection. (%d -)", MIN_WINDOW/1024+1))
+	windowAuto := cmd.Bool(
+		"windowAuto", false, "adjust the window from the measured RTT and throughput.")
+	retryBase := cmd.Float64(
+		"retryBase", 0.5, "seconds to wait before the first retry of the reconnection.")
+	retryMax := cmd.Float64(
+		"retryMax", 5, "max seconds to wait between the retries of the reconnection.")
+	retryJitter := cmd.Float64(
+		"retryJitter", 0.2, "ratio to randomize the wait of the reconnection. (0.0 - 1.0)")
+	maxOutage := cmd.Int(
+		"maxOutage", 0,
+		"seconds to give up the reconnection and start a new session. (0: never)")
+	resumeGrace := cmd.Int(
+		"resumeGrace", 600,
+		"seconds to wait for the client to resume the session. (0: forever)")
+	drainTimeout := cmd.Int(
+		"drainTimeout", 30,
+		"seconds to wait for the connections to end on SIGTERM.")
+	sessionBuf := cmd.Int(
+		"sessionBuf", 1024,
+		"max MB of the connection buffers per session. (0: unlimited)")
 	ctrl := cmd.String("ctrl", "", "[bench]")
 	prof := cmd.String("prof", "", "profile port. (:1234)")
 	console := cmd.String("console", "", "console port. (:1234)")
@@ -150,7 +219,10 @@ func ParseOpt(
 		}
 		fmt.Fprintf(cmd.Output(), "[option] \n\n")
 		fmt.Fprintf(cmd.Output(), "   server: e.g. localhost:1234 or :1234\n")
-		fmt.Fprintf(cmd.Output(), "   forward: listen-port,target-port  e.g. :1234,hoge.com:5678\n")
+		fmt.Fprintf(cmd.Output(), "   forward: listen-port,target-port[,option[,...]]  e.g. :1234,hoge.com:5678\n")
+		fmt.Fprintf(cmd.Output(), "     option: proxy=v1|v2  send PROXY protocol header to target-port\n")
+		fmt.Fprintf(cmd.Output(), "             comp=deflate|zstd|none  compress the forwarded data\n")
+		fmt.Fprintf(cmd.Output(), "             prio=high|normal|low  sending priority of the forwarded data\n")
 		fmt.Fprintf(cmd.Output(), "\n")
 		fmt.Fprintf(cmd.Output(), " options:\n")
 		cmd.PrintDefaults()
@@ -188,14 +260,21 @@ func ParseOpt(
 		usage()
 	}
 
-	var maskIP *MaskIP = nil
-	if *ipPattern != "" {
+	var ipFilter *IPFilter = nil
+	if *ipPattern != "" || *ipFile != "" {
 		var err error
-		maskIP, err = ippattern2MaskIP(*ipPattern)
+		ipFilter, err = NewIPFilter(*ipPattern, *ipFile)
 		if err != nil {
 			fmt.Println(err)
 			usage()
 		}
+		go ipFilter.Watch()
+	}
+
+	trustedProxyList, err := ippattern2MaskIPList(*trustProxy)
+	if err != nil {
+		fmt.Println(err)
+		usage()
 	}
 
 	verboseFlag = *verbose
@@ -212,10 +291,53 @@ func ParseOpt(
 		fmt.Print("'interval' is less than 2. force set 2.")
 		*interval = 2
 	}
+	if err := checkCompressName(*compress); err != nil {
+		fmt.Println(err)
+		usage()
+	}
+	if *reconnectMode != RECONNECT_MODE_QUEUE && *reconnectMode != RECONNECT_MODE_REJECT {
+		fmt.Printf("illegal reconnectMode -- %s\n", *reconnectMode)
+		usage()
+	}
+	if *frameSize < BUFSIZE || *frameSize > MAX_FRAME_SIZE {
+		fmt.Printf(
+			"'frameSize' is out of range. force set %d.\n", BUFSIZE)
+		*frameSize = BUFSIZE
+	}
+	if *window*1024 < MIN_WINDOW {
+		fmt.Printf(
+			"'window' is less than %d. force set %d.\n",
+			MIN_WINDOW/1024+1, MIN_WINDOW/1024+1)
+		*window = MIN_WINDOW/1024 + 1
+	}
+
+	if *retryMax < *retryBase {
+		*retryMax = *retryBase
+	}
+	if *retryJitter < 0 {
+		*retryJitter = 0
+	} else if *retryJitter > 1 {
+		*retryJitter = 1
+	}
 
 	param := TunnelParam{
-		pass, mode, maskIP, encPass, *encCount, *interval * 1000,
-		getKey(magic), 0, *serverInfo}
+		pass, mode, ipFilter, encPass, *encCount, *interval * 1000,
+		getKey(magic), 0, *serverInfo,
+		ClientLimit{
+			*maxSession, *rate, *rateIP, time.Duration(*lockout) * time.Second,
+			*maxHandshake},
+		trustedProxyList, *proxyProtocol,
+		int64(*rekeySize) * 1024 * 1024, time.Duration(*rekeyTime) * time.Second,
+		time.Duration(*authTimeout) * time.Second, *frameSize,
+		*compress, *compMin, time.Duration(*dialTimeout) * time.Second,
+		*reconnectMode, *window * 1024, *windowAuto, *deadCount,
+		ReconnectPolicy{
+			time.Duration(*retryBase * float64(time.Second)),
+			time.Duration(*retryMax * float64(time.Second)),
+			*retryJitter, time.Duration(*maxOutage) * time.Second},
+		time.Duration(*resumeGrace) * time.Second,
+		time.Duration(*drainTimeout) * time.Second,
+		int64(*sessionBuf) * 1024 * 1024}
 	if *ctrl == "bench" {
 		param.ctrl = CTRL_BENCH
 	}
@@ -240,7 +362,7 @@ func ParseOpt(
 	forwardList := []ForwardInfo{}
 	for _, arg := range nonFlagArgs[1:] {
 		tokenList := strings.Split(arg, ",")
-		if len(tokenList) != 2 {
+		if len(tokenList) < 2 {
 			fmt.Printf("illegal forward. need ',' -- %s", arg)
 			usage()
 		}
@@ -254,8 +376,14 @@ func ParseOpt(
 			fmt.Printf("illegal forward. -- %s", arg)
 			usage()
 		}
-		forwardList = append(
-			forwardList, ForwardInfo{Src: *srcInfo, Dst: *remoteInfo})
+		forwardInfo := ForwardInfo{Src: *srcInfo, Dst: *remoteInfo}
+		for _, opt := range tokenList[2:] {
+			if err := parseForwardOpt(&forwardInfo, opt); err != nil {
+				fmt.Printf("illegal forward. %s -- %s", err, arg)
+				usage()
+			}
+		}
+		forwardList = append(forwardList, forwardInfo)
 	}
 	if mode == "r-server" || mode == "r-wsserver" ||
 		mode == "client" || mode == "wsclient" {
@@ -268,10 +396,48 @@ func ParseOpt(
 	return &param, forwardList
 }
 
+// forward のオプションを解析する
+//
+// @param forwardInfo 解析結果を設定する ForwardInfo
+// @param opt オプション。 key=value 形式。
+func parseForwardOpt(forwardInfo *ForwardInfo, opt string) error {
+	keyVal := strings.SplitN(opt, "=", 2)
+	if len(keyVal) != 2 {
+		return fmt.Errorf("illegal option")
+	}
+	switch keyVal[0] {
+	case "proxy":
+		switch keyVal[1] {
+		case "v1":
+			forwardInfo.ProxyProtocol = 1
+		case "v2":
+			forwardInfo.ProxyProtocol = 2
+		default:
+			return fmt.Errorf("illegal proxy version")
+		}
+	case "prio":
+		weight, err := priorityName2weight(keyVal[1])
+		if err != nil {
+			return err
+		}
+		forwardInfo.Priority = weight
+	case "comp":
+		if err := checkCompressName(keyVal[1]); err != nil {
+			return err
+		}
+		forwardInfo.Compress = keyVal[1]
+	default:
+		return fmt.Errorf("unknown option")
+	}
+	return nil
+}
+
 func ParseOptServer(mode string, args []string) {
 	var cmd = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	param, forwardList := ParseOpt(cmd, mode, args)
 
+	go waitShutdown(param.drainTimeout)
+
 	switch mode {
 	case "server":
 		StartServer(param, forwardList)
@@ -294,6 +460,8 @@ func ParseOptClient(mode string, args []string) {
 	websocketServerInfo := HostInfo{
 		"ws://", param.serverInfo.Name, param.serverInfo.Port, "/"}
 
+	go waitShutdown(param.drainTimeout)
+
 	switch mode {
 	case "client":
 		StartClient(param, forwardList)
@@ -328,20 +496,6 @@ func ParseOptBot(mode string, args []string) {
 	StartBotServer(param.serverInfo)
 }
 
-func setsignal() {
-	sigchan := make(chan os.Signal)
-	signal.Notify(sigchan, os.Interrupt)
-	fmt.Print("wait sig")
-	<-sigchan
-	fmt.Print("detect sig")
-	signal.Stop(sigchan)
-
-	for {
-		time.Sleep(time.Second)
-		fmt.Print("hoge")
-	}
-}
-
 func test() {
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol v2 のシグネチャ
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v1 のヘッダの最大長
+const PROXY_PROTO_V1_MAX_LEN = 107
+
+// PROXY protocol のヘッダを読み込む際のタイムアウト
+const PROXY_HEADER_TIMEOUT = 10 * time.Second
+
+// PROXY protocol のヘッダを読み込む
+//
+// @param reader 読み込み元
+// @return net.Addr ヘッダに記載された接続元アドレス。
+//    LOCAL や UNKNOWN のように接続元の情報が無い場合は nil。
+// @return error
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	sig, err := reader.Peek(len(proxyProtoV2Sig))
+	if err == nil && bytes.Equal(sig, proxyProtoV2Sig) {
+		return readProxyHeaderV2(reader)
+	}
+	if head, err := reader.Peek(6); err == nil && string(head) == "PROXY " {
+		return readProxyHeaderV1(reader)
+	}
+	return nil, fmt.Errorf("not found PROXY protocol header")
+}
+
+// PROXY protocol v1 のヘッダを読み込む
+//
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, PROXY_PROTO_V1_MAX_LEN)
+	for {
+		char, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, char)
+		if char == '\n' {
+			break
+		}
+		if len(line) >= PROXY_PROTO_V1_MAX_LEN {
+			return nil, fmt.Errorf("PROXY v1 header is too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("illegal PROXY v1 header terminator")
+	}
+	txt := string(line[:len(line)-2])
+	tokenList := strings.Split(txt, " ")
+	if len(tokenList) >= 2 && tokenList[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(tokenList) != 6 || (tokenList[1] != "TCP4" && tokenList[1] != "TCP6") {
+		return nil, fmt.Errorf("illegal PROXY v1 header -- %s", txt)
+	}
+	isV4 := tokenList[1] == "TCP4"
+	srcIp := parseProxyV1Ip(tokenList[2], isV4)
+	dstIp := parseProxyV1Ip(tokenList[3], isV4)
+	srcPort := parseProxyV1Port(tokenList[4])
+	dstPort := parseProxyV1Port(tokenList[5])
+	if srcIp == nil || dstIp == nil || srcPort < 0 || dstPort < 0 {
+		return nil, fmt.Errorf("illegal PROXY v1 header -- %s", txt)
+	}
+	return &net.TCPAddr{IP: srcIp, Port: srcPort}, nil
+}
+
+// PROXY protocol v1 のアドレスを解析する
+//
+// @param txt アドレス
+// @param isV4 TCP4 の場合 true。 TCP6 の場合 false。
+// @return net.IP アドレスが family と一致しない場合は nil
+func parseProxyV1Ip(txt string, isV4 bool) net.IP {
+	ip := net.ParseIP(txt)
+	if ip == nil {
+		return nil
+	}
+	// TCP4 に IPv6 表記 (::ffff:192.168.0.1 など) は使えない
+	if isV4 != !strings.Contains(txt, ":") {
+		return nil
+	}
+	return ip
+}
+
+// PROXY protocol v1 のポート番号を解析する
+//
+// @return int 不正な場合は -1
+func parseProxyV1Port(txt string) int {
+	if len(txt) == 0 || len(txt) > 5 || (len(txt) > 1 && txt[0] == '0') {
+		return -1
+	}
+	for _, char := range txt {
+		if char < '0' || char > '9' {
+			return -1
+		}
+	}
+	port, _ := strconv.Atoi(txt)
+	if port > 65535 {
+		return -1
+	}
+	return port
+}
+
+// PROXY protocol v2 のヘッダを読み込む
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtoV2Sig)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	verCmd := header[12]
+	family := header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("illegal PROXY v2 version -- %x", verCmd)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	switch verCmd & 0xf {
+	case 0:
+		// LOCAL
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("illegal PROXY v2 command -- %x", verCmd)
+	}
+
+	switch family >> 4 {
+	case 1:
+		// AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short PROXY v2 header -- %d", len(body))
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 2:
+		// AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short PROXY v2 header -- %d", len(body))
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	case 0, 3:
+		// AF_UNSPEC, AF_UNIX は接続元の情報として扱わない
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported PROXY v2 family -- %x", family)
+}
+
+// PROXY protocol のヘッダを読み込んだ後のコネクション
+//
+// ヘッダは最初の Read() か RemoteAddr() で読み込む。
+// Accept() で読み込むと、そのヘッダを読み込む間 Accept() が止まるので、
+// コネクション毎の処理側で読み込むようにしている。
+type proxyProtoConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (conn *proxyProtoConn) init() {
+	conn.once.Do(func() {
+		conn.reader = bufio.NewReader(conn.Conn)
+		conn.Conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+		conn.remoteAddr, conn.err = readProxyHeader(conn.reader)
+		conn.Conn.SetReadDeadline(time.Time{})
+		if conn.err != nil {
+			log.Printf(
+				"failed to read PROXY header -- %s, %s", conn.Conn.RemoteAddr(), conn.err)
+		}
+	})
+}
+
+func (conn *proxyProtoConn) Read(p []byte) (int, error) {
+	conn.init()
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	return conn.reader.Read(p)
+}
+
+func (conn *proxyProtoConn) RemoteAddr() net.Addr {
+	conn.init()
+	if conn.remoteAddr != nil {
+		return conn.remoteAddr
+	}
+	return conn.Conn.RemoteAddr()
+}
+
+// 信頼する proxy から接続された場合に、PROXY protocol のヘッダを読み込む listener
+type proxyProtoListener struct {
+	net.Listener
+	param *TunnelParam
+}
+
+func (listener *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return wrapProxyProtoConn(conn, listener.param), nil
+}
+
+// 信頼する proxy からの接続の場合、 conn を proxyProtoConn でラップする
+//
+// ヘッダはまだ読み込まない。
+func wrapProxyProtoConn(conn net.Conn, param *TunnelParam) net.Conn {
+	if !isTrustedProxy(param, remoteAddr2ip(conn.RemoteAddr().String())) {
+		return conn
+	}
+	return &proxyProtoConn{Conn: conn}
+}
+
+// PROXY protocol が有効な場合、 conn のヘッダを読み込む
+//
+// ヘッダを読み込む間は止まるので、 Accept() したループではなく、
+// コネクション毎の goroutine から呼び出す。
+//
+// @return net.Conn ヘッダを読み込んだ後のコネクション
+// @return error ヘッダを読み込めなかった場合
+func readProxyProtoConn(conn net.Conn, param *TunnelParam) (net.Conn, error) {
+	if !param.proxyProtocol {
+		return conn, nil
+	}
+	wrapped := wrapProxyProtoConn(conn, param)
+	if proxyConn, ok := wrapped.(*proxyProtoConn); ok {
+		proxyConn.init()
+		if proxyConn.err != nil {
+			return nil, proxyConn.err
+		}
+	}
+	return wrapped, nil
+}
+
+// PROXY protocol が有効な場合、 local を proxyProtoListener でラップする
+func wrapProxyProtoListener(local net.Listener, param *TunnelParam) net.Listener {
+	if !param.proxyProtocol {
+		return local
+	}
+	return &proxyProtoListener{local, param}
+}
+
+// 相手から要求された接続で、 PROXY protocol のヘッダを送るか確認する
+//
+// PROXY protocol のヘッダを信用する接続先に、偽の接続元アドレスを送らせないように、
+// 認証時に確定した forward の設定で、その接続先に指定されている場合だけ送る。
+//
+// @param header 相手から要求された接続
+// @return int 送る PROXY protocol のバージョン。送らない場合は 0。
+// @return error 接続元アドレスが不正な場合
+func (sessionInfo *SessionInfo) checkProxyProtocol(header *ConnHeader) (int, error) {
+	if header.ProxyProtocol == 0 {
+		return 0, nil
+	}
+	enabled := false
+	for _, forwardInfo := range sessionInfo.forwardList {
+		if forwardInfo.Dst.toStr() == header.HostInfo.toStr() &&
+			forwardInfo.ProxyProtocol == header.ProxyProtocol {
+			enabled = true
+			break
+		}
+	}
+	if !enabled {
+		log.Printf(
+			"PROXY header is not enabled for the destination -- %s",
+			header.HostInfo.toStr())
+		return 0, nil
+	}
+	if addrTxt2ProxyAddrInfo(header.SrcAddr) == nil ||
+		addrTxt2ProxyAddrInfo(header.ListenAddr) == nil {
+		return 0, fmt.Errorf(
+			"%w -- illegal address for PROXY header %s, %s",
+			ErrIllegalMessage, header.SrcAddr, header.ListenAddr)
+	}
+	return header.ProxyProtocol, nil
+}
+
+// PROXY protocol ヘッダのアドレス情報
+type proxyAddrInfo struct {
+	ip   net.IP
+	port int
+}
+
+func addrTxt2ProxyAddrInfo(addr string) *proxyAddrInfo {
+	host, portTxt, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portTxt)
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil
+	}
+	return &proxyAddrInfo{ip, port}
+}
+
+// PROXY protocol のヘッダを出力する
+//
+// @param ostream 出力先
+// @param version PROXY protocol のバージョン。 1 or 2。
+// @param srcAddr 接続元アドレス (host:port)
+// @param dstAddr 接続先アドレス (host:port)
+func writeProxyHeader(ostream io.Writer, version int, srcAddr, dstAddr string) error {
+	src := addrTxt2ProxyAddrInfo(srcAddr)
+	dst := addrTxt2ProxyAddrInfo(dstAddr)
+	isV4 := false
+	if src != nil && dst != nil {
+		if src.ip.To4() != nil && dst.ip.To4() != nil {
+			isV4 = true
+			src.ip = src.ip.To4()
+			dst.ip = dst.ip.To4()
+		} else if src.ip.To4() == nil && dst.ip.To4() == nil {
+			src.ip = src.ip.To16()
+			dst.ip = dst.ip.To16()
+		} else {
+			// IPv4 と IPv6 が混在する場合は、 TCP4/TCP6 のどちらでも表現できないので、
+			// 接続元の情報なしとして送る
+			src = nil
+		}
+	}
+
+	var buffer bytes.Buffer
+	switch version {
+	case 1:
+		if src == nil || dst == nil {
+			buffer.WriteString("PROXY UNKNOWN\r\n")
+		} else {
+			proto := "TCP6"
+			if isV4 {
+				proto = "TCP4"
+			}
+			fmt.Fprintf(
+				&buffer, "PROXY %s %s %s %d %d\r\n",
+				proto, src.ip, dst.ip, src.port, dst.port)
+		}
+	case 2:
+		buffer.Write(proxyProtoV2Sig)
+		// version 2, PROXY コマンド
+		buffer.WriteByte(0x21)
+		if src == nil || dst == nil {
+			// AF_UNSPEC
+			buffer.Write([]byte{0x00, 0x00, 0x00})
+		} else {
+			if isV4 {
+				// AF_INET, STREAM
+				buffer.Write([]byte{0x11, 0x00, 12})
+			} else {
+				// AF_INET6, STREAM
+				buffer.Write([]byte{0x21, 0x00, 36})
+			}
+			buffer.Write(src.ip)
+			buffer.Write(dst.ip)
+			binary.Write(&buffer, binary.BigEndian, uint16(src.port))
+			binary.Write(&buffer, binary.BigEndian, uint16(dst.port))
+		}
+	default:
+		return fmt.Errorf("illegal PROXY protocol version -- %d", version)
+	}
+	_, err := buffer.WriteTo(ostream)
+	return err
+}
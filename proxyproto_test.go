@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// PROXY protocol v2 のヘッダを生成する
+func proxyHeaderV2(verCmd byte, family byte, body []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.Write(proxyProtoV2Sig)
+	buffer.WriteByte(verCmd)
+	buffer.WriteByte(family)
+	binary.Write(&buffer, binary.BigEndian, uint16(len(body)))
+	buffer.Write(body)
+	return buffer.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4Body := []byte{192, 168, 0, 1, 192, 168, 0, 11, 0xdc, 0x04, 0x01, 0xbb}
+	v6Body := make([]byte, 36)
+	copy(v6Body, net.ParseIP("2001:db8::1"))
+	copy(v6Body[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(v6Body[32:], 56324)
+	binary.BigEndian.PutUint16(v6Body[34:], 443)
+
+	testList := []struct {
+		name string
+		data string
+		// 期待する接続元アドレス。 "" の場合は接続元の情報なし。
+		addr string
+		err  bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", "192.168.0.1:56324", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 unknown with addr", "PROXY UNKNOWN 192.168.0.1 192.168.0.11 56324 443\r\n", "", false},
+		{"v1 tcp4 with ipv6", "PROXY TCP4 ::ffff:192.168.0.1 192.168.0.11 56324 443\r\n", "", true},
+		{"v1 tcp6 with ipv4", "PROXY TCP6 192.168.0.1 2001:db8::2 56324 443\r\n", "", true},
+		{"v1 illegal dst", "PROXY TCP4 192.168.0.1 host 56324 443\r\n", "", true},
+		{"v1 illegal port", "PROXY TCP4 192.168.0.1 192.168.0.11 65536 443\r\n", "", true},
+		{"v1 signed port", "PROXY TCP4 192.168.0.1 192.168.0.11 +80 443\r\n", "", true},
+		{"v1 lack field", "PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n", "", true},
+		{"v1 without cr", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n", "", true},
+		{"v1 too long", "PROXY UNKNOWN " + strings.Repeat("a", PROXY_PROTO_V1_MAX_LEN) + "\r\n", "", true},
+		{"v1 truncated", "PROXY TCP4 192.168.0.1", "", true},
+		{"v2 local", string(proxyHeaderV2(0x20, 0x00, nil)), "", false},
+		{"v2 proxy tcp4", string(proxyHeaderV2(0x21, 0x11, v4Body)), "192.168.0.1:56324", false},
+		{"v2 proxy tcp6", string(proxyHeaderV2(0x21, 0x21, v6Body)), "[2001:db8::1]:56324", false},
+		{"v2 unspec", string(proxyHeaderV2(0x21, 0x00, nil)), "", false},
+		{"v2 unix", string(proxyHeaderV2(0x21, 0x31, make([]byte, 216))), "", false},
+		{"v2 unsupported family", string(proxyHeaderV2(0x21, 0x41, v4Body)), "", true},
+		{"v2 short body", string(proxyHeaderV2(0x21, 0x11, v4Body[:8])), "", true},
+		{"v2 truncated", string(proxyHeaderV2(0x21, 0x11, v4Body))[:20], "", true},
+		{"v2 illegal version", string(proxyHeaderV2(0x11, 0x11, v4Body)), "", true},
+		{"v2 illegal command", string(proxyHeaderV2(0x22, 0x11, v4Body)), "", true},
+		{"no header", "GET / HTTP/1.1\r\n", "", true},
+	}
+	for _, test := range testList {
+		addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(test.data)))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: no error -- %v", test.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		txt := ""
+		if addr != nil {
+			txt = addr.String()
+		}
+		if txt != test.addr {
+			t.Errorf("%s: unmatch addr -- %s, %s", test.name, txt, test.addr)
+		}
+	}
+}
+
+// writeProxyHeader() で出力したヘッダを読み込めることを確認する
+func TestWriteProxyHeader(t *testing.T) {
+	testList := []struct {
+		src  string
+		dst  string
+		addr string
+	}{
+		{"192.168.0.1:56324", "192.168.0.11:443", "192.168.0.1:56324"},
+		{"[2001:db8::1]:56324", "[2001:db8::2]:443", "[2001:db8::1]:56324"},
+		{"192.168.0.1:56324", "[2001:db8::2]:443", ""},
+		{"pipe", "192.168.0.11:443", ""},
+	}
+	for version := 1; version <= 2; version++ {
+		for _, test := range testList {
+			var buffer bytes.Buffer
+			if err := writeProxyHeader(&buffer, version, test.src, test.dst); err != nil {
+				t.Fatal(err)
+			}
+			addr, err := readProxyHeader(bufio.NewReader(&buffer))
+			if err != nil {
+				t.Errorf("v%d %s: %s", version, test.src, err)
+				continue
+			}
+			txt := ""
+			if addr != nil {
+				txt = addr.String()
+			}
+			if txt != test.addr {
+				t.Errorf("v%d %s: unmatch addr -- %s, %s", version, test.src, txt, test.addr)
+			}
+		}
+	}
+}
+
+// forward の設定で指定された接続先にだけ、 PROXY protocol のヘッダを送ることを確認する
+func TestCheckProxyProtocol(t *testing.T) {
+	sessionInfo := newEmptySessionInfo(0, "", true)
+	sessionInfo.forwardList = []ForwardInfo{
+		{HostInfo{"", "", 20080, ""}, HostInfo{"", "localhost", 80, ""}, 1, "", 0},
+		{HostInfo{"", "", 20022, ""}, HostInfo{"", "localhost", 22, ""}, 0, "", 0},
+	}
+	testList := []struct {
+		name     string
+		header   ConnHeader
+		protocol int
+		err      bool
+	}{
+		{"enabled", ConnHeader{
+			HostInfo{"", "localhost", 80, ""}, CITIID_USR, 1,
+			"192.168.0.1:56324", "192.168.0.11:20080", "", 0}, 1, false},
+		{"not requested", ConnHeader{
+			HostInfo{"", "localhost", 80, ""}, CITIID_USR, 0,
+			"192.168.0.1:56324", "192.168.0.11:20080", "", 0}, 0, false},
+		{"other version", ConnHeader{
+			HostInfo{"", "localhost", 80, ""}, CITIID_USR, 2,
+			"192.168.0.1:56324", "192.168.0.11:20080", "", 0}, 0, false},
+		{"not enabled", ConnHeader{
+			HostInfo{"", "localhost", 22, ""}, CITIID_USR, 1,
+			"192.168.0.1:56324", "192.168.0.11:20022", "", 0}, 0, false},
+		{"unknown destination", ConnHeader{
+			HostInfo{"", "backend", 80, ""}, CITIID_USR, 1,
+			"192.168.0.1:56324", "192.168.0.11:20080", "", 0}, 0, false},
+		{"illegal src", ConnHeader{
+			HostInfo{"", "localhost", 80, ""}, CITIID_USR, 1,
+			"host:56324", "192.168.0.11:20080", "", 0}, 0, true},
+		{"src without port", ConnHeader{
+			HostInfo{"", "localhost", 80, ""}, CITIID_USR, 1,
+			"192.168.0.1", "192.168.0.11:20080", "", 0}, 0, true},
+	}
+	for _, test := range testList {
+		protocol, err := sessionInfo.checkProxyProtocol(&test.header)
+		if (err != nil) != test.err {
+			t.Errorf("%s: unmatch error -- %v", test.name, err)
+		}
+		if protocol != test.protocol {
+			t.Errorf("%s: unmatch protocol -- %d, %d", test.name, protocol, test.protocol)
+		}
+	}
+}
+
+// 不正な PROXY protocol のヘッダを受けても、 panic しないことを確認する
+func FuzzReadProxyHeader(f *testing.F) {
+	f.Add([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"))
+	f.Add([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"))
+	f.Add([]byte("PROXY UNKNOWN\r\n"))
+	f.Add(proxyHeaderV2(0x20, 0x00, nil))
+	f.Add(proxyHeaderV2(
+		0x21, 0x11, []byte{192, 168, 0, 1, 192, 168, 0, 11, 0xdc, 0x04, 0x01, 0xbb}))
+	f.Add(proxyHeaderV2(0x21, 0x21, make([]byte, 36)))
+	f.Add(proxyHeaderV2(0x21, 0x11, []byte{1, 2, 3}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bufio.NewReader(bytes.NewReader(data))
+		addr, err := readProxyHeader(reader)
+		if err != nil || addr == nil {
+			return
+		}
+		tcpAddr, ok := addr.(*net.TCPAddr)
+		if !ok {
+			t.Fatalf("illegal addr type -- %T", addr)
+		}
+		if tcpAddr.IP == nil || tcpAddr.Port < 0 || tcpAddr.Port > 65535 {
+			t.Fatalf("illegal addr -- %s", addr)
+		}
+	})
+}
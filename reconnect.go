@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 再接続の待ち時間の方針
+type ReconnectPolicy struct {
+	// 最初の再接続の待ち時間。失敗するごとに倍にする。
+	base time.Duration
+	// 待ち時間の上限
+	max time.Duration
+	// 待ち時間をずらす割合 (0.0 - 1.0)。
+	// 複数のクライアントが同時に再接続しに来ないように、待ち時間を
+	// この割合の範囲でランダムに増減する。
+	jitter float64
+	// 再接続を諦めるまでの時間。 0 の場合は諦めない。
+	// 諦めたセッションは破棄して、新しいセッションを開始する。
+	// 新しいセッションの接続は、諦めずに再試行を続ける。
+	maxOutage time.Duration
+}
+
+// 再接続の待ち時間を取得する
+//
+// @param attempt 失敗した回数。 0 から。
+// @return time.Duration 待ち時間
+func (policy *ReconnectPolicy) wait(attempt int) time.Duration {
+	wait := policy.base
+	for count := 0; count < attempt && wait < policy.max; count++ {
+		wait *= 2
+	}
+	if wait > policy.max {
+		wait = policy.max
+	}
+	if policy.jitter > 0 {
+		wait += time.Duration(
+			float64(wait) * policy.jitter * (rand.Float64()*2 - 1))
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// 再接続のイベントの種類
+// 再接続に失敗して、待ってから再試行する
+const RECONNECT_EVENT_RETRY = "retry"
+
+// 再接続に成功した
+const RECONNECT_EVENT_OK = "ok"
+
+// 続けても接続できないエラーで、再接続をやめた
+const RECONNECT_EVENT_FAIL = "fail"
+
+// maxOutage を越えたので、再接続を諦めた
+const RECONNECT_EVENT_GIVEUP = "giveup"
+
+// リセットされたセッションなので、再接続しなかった
+const RECONNECT_EVENT_RESET = "reset"
+
+// 保持する再接続のイベントの数
+const RECONNECT_EVENT_MAX = 100
+
+// 再接続のイベント
+type ReconnectEvent struct {
+	time time.Time
+	// セッション ID。新しいセッションの接続の場合は 0。
+	sessionId int
+	// RECONNECT_EVENT_*
+	kind string
+	// 何回目の接続か。 1 から。
+	attempt int
+	// 次の接続までの待ち時間
+	wait time.Duration
+	// 接続に失敗した理由
+	err string
+}
+
+// 再接続のイベントの記録
+type reconnectEventInfo struct {
+	mutex sync.Mutex
+	// 新しい順ではなく、発生順に保持する
+	list []ReconnectEvent
+	// RECONNECT_EVENT_* → 発生回数
+	kind2count map[string]int64
+}
+
+var reconnectEvents = reconnectEventInfo{
+	sync.Mutex{}, []ReconnectEvent{}, map[string]int64{}}
+
+// 再接続のイベントを記録する
+func addReconnectEvent(event ReconnectEvent) {
+	reconnectEvents.mutex.Lock()
+	defer reconnectEvents.mutex.Unlock()
+
+	reconnectEvents.list = append(reconnectEvents.list, event)
+	if len(reconnectEvents.list) > RECONNECT_EVENT_MAX {
+		reconnectEvents.list = reconnectEvents.list[1:]
+	}
+	reconnectEvents.kind2count[event.kind]++
+}
+
+// 再接続のイベントを出力する
+func DumpReconnectEvents(stream io.Writer) {
+	reconnectEvents.mutex.Lock()
+	defer reconnectEvents.mutex.Unlock()
+
+	fmt.Fprintf(stream, "------------\n")
+	for _, event := range reconnectEvents.list {
+		fmt.Fprintf(
+			stream, "%s: session %d, %s, attempt %d",
+			event.time.Format("2006-01-02 15:04:05"), event.sessionId,
+			event.kind, event.attempt)
+		if event.kind == RECONNECT_EVENT_RETRY {
+			fmt.Fprintf(stream, ", wait %s", event.wait.Round(time.Millisecond))
+		}
+		if event.err != "" {
+			fmt.Fprintf(stream, " -- %s", event.err)
+		}
+		fmt.Fprintf(stream, "\n")
+	}
+	fmt.Fprintf(
+		stream, "retry: %d, ok: %d, fail: %d, giveup: %d, reset: %d\n",
+		reconnectEvents.kind2count[RECONNECT_EVENT_RETRY],
+		reconnectEvents.kind2count[RECONNECT_EVENT_OK],
+		reconnectEvents.kind2count[RECONNECT_EVENT_FAIL],
+		reconnectEvents.kind2count[RECONNECT_EVENT_GIVEUP],
+		reconnectEvents.kind2count[RECONNECT_EVENT_RESET])
+}
+
+// 再接続する関数を生成する
+//
+// 接続に失敗した場合は、 policy に従って待ち時間を延ばしながら再試行する。
+//
+// @param policy 再接続の方針
+// @param reconnect 1 回分の接続処理
+// @return func 接続関数。 sessionInfo が nil の場合は新しいセッションを接続する。
+// 続けても接続できないエラーの場合と、セッションの再接続を諦めた場合は nil を返す。
+func CreateToReconnectFunc(
+	policy *ReconnectPolicy,
+	reconnect func(sessionInfo *SessionInfo) ReconnectInfo) func(sessionInfo *SessionInfo) *ConnInfo {
+	return func(sessionInfo *SessionInfo) *ConnInfo {
+		sessionId := 0
+		if sessionInfo != nil {
+			sessionId = sessionInfo.SessionId
+		}
+		start := time.Now()
+		for attempt := 1; ; attempt++ {
+			if sessionInfo != nil && sessionInfo.isReset() {
+				// リセットしたセッションは再開しない
+				log.Print("reconnect -- reset session: ", sessionId)
+				addReconnectEvent(ReconnectEvent{
+					time.Now(), sessionId, RECONNECT_EVENT_RESET, attempt, 0,
+					sessionInfo.resetReason})
+				return nil
+			}
+			log.Printf("reconnecting... session: %d, attempt: %d", sessionId, attempt)
+			reconnectInfo := reconnect(sessionInfo)
+			if reconnectInfo.Err == nil {
+				log.Print("reconnect -- ok session: ", sessionId)
+				addReconnectEvent(ReconnectEvent{
+					time.Now(), sessionId, RECONNECT_EVENT_OK, attempt, 0, ""})
+				return reconnectInfo.Conn
+			}
+			log.Printf("reconnecting error -- %s\n", reconnectInfo.Err)
+			if !reconnectInfo.Cont {
+				log.Print("reconnect -- ng session: ", sessionId)
+				addReconnectEvent(ReconnectEvent{
+					time.Now(), sessionId, RECONNECT_EVENT_FAIL, attempt, 0,
+					reconnectInfo.Err.Error()})
+				return nil
+			}
+			wait := policy.wait(attempt - 1)
+			if sessionInfo != nil && policy.maxOutage > 0 &&
+				time.Now().Add(wait).Sub(start) > policy.maxOutage {
+				// 待っても maxOutage までに接続できないので、このセッションは諦める。
+				// 呼び出し元は、新しいセッションの接続を始める。
+				reason := fmt.Sprintf(
+					"reconnect outage over %s -- %s", policy.maxOutage, reconnectInfo.Err)
+				log.Printf("reconnect -- give up session: %d, %s", sessionId, reason)
+				addReconnectEvent(ReconnectEvent{
+					time.Now(), sessionId, RECONNECT_EVENT_GIVEUP, attempt, 0, reason})
+				sessionInfo.reset(reason)
+				return nil
+			}
+			addReconnectEvent(ReconnectEvent{
+				time.Now(), sessionId, RECONNECT_EVENT_RETRY, attempt, wait,
+				reconnectInfo.Err.Error()})
+			time.Sleep(wait)
+		}
+	}
+}
+
+// tunnel のセッションを監視して、終了したら新しいセッションを開始する
+//
+// 再接続を諦めたセッションやリセットされたセッションは、
+// 後始末をしてから新しいセッションに置き換える。
+//
+// @param connect 接続関数。 CreateToReconnectFunc() で生成したもの。
+// @param process セッションの処理。セッションが終了したら返る。
+// 続けられないエラーの場合は false を返す。
+func superviseSession(
+	connect func(sessionInfo *SessionInfo) *ConnInfo,
+	process func(connInfo *ConnInfo) bool) {
+	for {
+		connInfo := connect(nil)
+		if connInfo == nil {
+			// 認証エラーなど、続けても接続できない
+			log.Print("failed to start a session")
+			break
+		}
+		cont := process(connInfo)
+		connInfo.Conn.Close()
+		if !cont {
+			break
+		}
+		log.Printf(
+			"session ended -- %d, start a new session", connInfo.SessionInfo.SessionId)
+	}
+}
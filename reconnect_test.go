@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// 失敗するごとに待ち時間を倍にして、上限で止めることを確認する
+func TestReconnectPolicyWait(t *testing.T) {
+	policy := ReconnectPolicy{100 * time.Millisecond, time.Second, 0, 0}
+	expectList := []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		800 * time.Millisecond, time.Second, time.Second}
+	for attempt, expect := range expectList {
+		if wait := policy.wait(attempt); wait != expect {
+			t.Errorf("unmatch wait -- %d, %s, %s", attempt, wait, expect)
+		}
+	}
+	if wait := policy.wait(1000); wait != time.Second {
+		t.Errorf("wait is over max -- %s", wait)
+	}
+
+	// jitter の割合の範囲で増減する
+	policy.jitter = 0.2
+	for count := 0; count < 100; count++ {
+		wait := policy.wait(10)
+		if wait < 800*time.Millisecond || wait > 1200*time.Millisecond {
+			t.Fatalf("wait is out of jitter -- %s", wait)
+		}
+	}
+}
+
+// 接続に失敗するダミーの接続処理を生成する
+//
+// @param okAttempt この回数目で接続に成功する。 0 の場合は成功しない。
+// @param cont 失敗した際に再試行できる場合 true
+// @param count 接続処理の回数
+func failedReconnect(
+	okAttempt int, cont bool, count *int) func(sessionInfo *SessionInfo) ReconnectInfo {
+	return func(sessionInfo *SessionInfo) ReconnectInfo {
+		*count++
+		if *count == okAttempt {
+			return ReconnectInfo{&ConnInfo{Conn: dummyConn}, true, nil}
+		}
+		return ReconnectInfo{nil, cont, errors.New("connection refused")}
+	}
+}
+
+// maxOutage を越えたセッションの再接続を諦めて、リセットすることを確認する
+func TestReconnectGiveUp(t *testing.T) {
+	discardLog(t)
+	policy := ReconnectPolicy{time.Millisecond, time.Millisecond, 0, 5 * time.Millisecond}
+
+	count := 0
+	connect := CreateToReconnectFunc(&policy, failedReconnect(0, true, &count))
+	sessionInfo := newEmptySessionInfo(1, "", false)
+	if connect(sessionInfo) != nil {
+		t.Fatal("reconnect without server")
+	}
+	if !sessionInfo.isReset() {
+		t.Errorf("session is not reset")
+	}
+	if count < 2 {
+		t.Errorf("give up without retry -- %d", count)
+	}
+
+	// リセットしたセッションは、再接続しない
+	count = 0
+	if connect(sessionInfo) != nil || count != 0 {
+		t.Errorf("reconnect the reset session -- %d", count)
+	}
+}
+
+// 新しいセッションの接続は、 maxOutage を越えても再試行を続けることを確認する
+func TestReconnectNewSession(t *testing.T) {
+	discardLog(t)
+	policy := ReconnectPolicy{time.Millisecond, time.Millisecond, 0, time.Millisecond}
+
+	count := 0
+	connect := CreateToReconnectFunc(&policy, failedReconnect(10, true, &count))
+	if connInfo := connect(nil); connInfo == nil || count != 10 {
+		t.Errorf("give up the new session -- %d", count)
+	}
+
+	// 続けても接続できないエラーでは、すぐに諦める
+	count = 0
+	connect = CreateToReconnectFunc(&policy, failedReconnect(0, false, &count))
+	if connect(nil) != nil || count != 1 {
+		t.Errorf("retry the unrecoverable error -- %d", count)
+	}
+}
+
+// セッションが終了したら新しいセッションを開始し、
+// 接続できないエラーで終了することを確認する
+func TestSuperviseSession(t *testing.T) {
+	discardLog(t)
+	policy := ReconnectPolicy{time.Millisecond, time.Millisecond, 0, time.Millisecond}
+
+	count := 0
+	connect := CreateToReconnectFunc(&policy, func(sessionInfo *SessionInfo) ReconnectInfo {
+		count++
+		if count <= 2 {
+			return ReconnectInfo{
+				&ConnInfo{Conn: dummyConn, SessionInfo: newEmptySessionInfo(count, "", false)},
+				true, nil}
+		}
+		return ReconnectInfo{nil, false, errors.New("auth error")}
+	})
+	sessionIdList := []int{}
+	superviseSession(connect, func(connInfo *ConnInfo) bool {
+		sessionIdList = append(sessionIdList, connInfo.SessionInfo.SessionId)
+		return true
+	})
+	if len(sessionIdList) != 2 || sessionIdList[0] != 1 || sessionIdList[1] != 2 {
+		t.Errorf("unmatch sessions -- %v", sessionIdList)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// citi の送信優先度。 DRR で 1 巡ごとに送信できる量の重み。
+const PRIORITY_LOW = 1
+const PRIORITY_NORMAL = 2
+const PRIORITY_HIGH = 4
+
+// citi ごとのキューに溜められるパケット数。
+// これを越えると、 Push() で空くのを待つ。
+const CITI_QUEUE_NUM = PACKET_NUM_BASE
+
+// 優先度の名前から重みを取得する
+func priorityName2weight(name string) (int, error) {
+	switch name {
+	case "low":
+		return PRIORITY_LOW, nil
+	case "normal":
+		return PRIORITY_NORMAL, nil
+	case "high":
+		return PRIORITY_HIGH, nil
+	}
+	return 0, fmt.Errorf("illegal priority -- %s", name)
+}
+
+// citi ごとの送信待ちキュー
+type citiQueue struct {
+	citiId uint32
+	// 送信待ちの PackInfo
+	packets *list.List
+	// DRR で送信できる残り量
+	deficit int
+}
+
+// tunnel に送信するパケットのスケジューラ
+//
+// 制御用のパケット (CITIID_CTRL 宛と SYNC) は、他のパケットより優先して送信する。
+// citi のデータは citi ごとのキューに入れて、
+// deficit round-robin で優先度に応じて公平に送信する。
+// これにより、大量のデータを送信している citi があっても、
+// 他の citi の通信や接続処理が待たされないようにする。
+type PacketScheduler struct {
+	mutex sync.Mutex
+	// パケットの追加と取り出しを待つための cond
+	cond *sync.Cond
+	// 優先して送信するパケット
+	prioQueue *list.List
+	// citiId → 送信待ちキュー。送信待ちがない citi は持たない。
+	citiId2queue map[uint32]*citiQueue
+	// 送信待ちがある citiQueue のリスト。ラウンドロビンの順番。
+	activeList *list.List
+	// citiId → 優先度の重み
+	citiId2weight map[uint32]int
+	// DRR で 1 巡ごとに送信できる量の基準
+	quantum int
+	// 送信待ちのパケット数
+	count int
+}
+
+func NewPacketScheduler() *PacketScheduler {
+	sched := &PacketScheduler{
+		prioQueue:     new(list.List),
+		citiId2queue:  map[uint32]*citiQueue{},
+		activeList:    new(list.List),
+		citiId2weight: map[uint32]int{},
+		quantum:       BUFSIZE + PACKET_LEN_HEADER,
+	}
+	sched.cond = sync.NewCond(&sched.mutex)
+	return sched
+}
+
+// パケットを優先して送信するかどうか
+func isPrioPacket(packet *PackInfo) bool {
+	return packet.citiId == CITIID_CTRL || packet.kind == PACKET_KIND_SYNC
+}
+
+// DRR の基準量を設定する
+//
+// @param frameSize 1 フレームの最大サイズ
+func (sched *PacketScheduler) SetFrameSize(frameSize int) {
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	sched.quantum = frameSize + PACKET_LEN_HEADER
+}
+
+// citi の優先度を設定する
+//
+// @param citiId citi
+// @param weight PRIORITY_*。 0 以下の場合は PRIORITY_NORMAL。
+func (sched *PacketScheduler) SetPriority(citiId uint32, weight int) {
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	if weight <= 0 {
+		weight = PRIORITY_NORMAL
+	}
+	sched.citiId2weight[citiId] = weight
+}
+
+// 終了した citi の情報を削除する
+func (sched *PacketScheduler) Forget(citiId uint32) {
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	delete(sched.citiId2weight, citiId)
+}
+
+// パケットを送信待ちに追加する
+//
+// citi のキューが一杯の場合は、空くまで待つ。
+func (sched *PacketScheduler) Push(packet PackInfo) {
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	if isPrioPacket(&packet) {
+		sched.prioQueue.PushBack(packet)
+	} else {
+		queue, has := sched.citiId2queue[packet.citiId]
+		for has && queue.packets.Len() >= CITI_QUEUE_NUM {
+			sched.cond.Wait()
+			queue, has = sched.citiId2queue[packet.citiId]
+		}
+		if !has {
+			queue = &citiQueue{packet.citiId, new(list.List), 0}
+			sched.citiId2queue[packet.citiId] = queue
+			sched.activeList.PushBack(queue)
+		}
+		queue.packets.PushBack(packet)
+	}
+	sched.count++
+	sched.cond.Broadcast()
+}
+
+// 次に送信するパケットを取り出す
+//
+// 送信待ちのパケットがない場合は、追加されるまで待つ。
+func (sched *PacketScheduler) Pop() PackInfo {
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	for sched.count == 0 {
+		sched.cond.Wait()
+	}
+	sched.count--
+	// 取り出すことで citi のキューに空きができるので、 Push() 側を起こす
+	defer sched.cond.Broadcast()
+
+	if sched.prioQueue.Len() > 0 {
+		return sched.prioQueue.Remove(sched.prioQueue.Front()).(PackInfo)
+	}
+
+	for {
+		elem := sched.activeList.Front()
+		queue := elem.Value.(*citiQueue)
+		packet := queue.packets.Front().Value.(PackInfo)
+		cost := len(packet.bytes) + PACKET_LEN_HEADER
+		if queue.deficit < cost {
+			// この citi は今回の送信量を使い切ったので、次の citi に回す
+			weight, has := sched.citiId2weight[queue.citiId]
+			if !has {
+				weight = PRIORITY_NORMAL
+			}
+			queue.deficit += sched.quantum * weight
+			sched.activeList.MoveToBack(elem)
+			continue
+		}
+		queue.deficit -= cost
+		queue.packets.Remove(queue.packets.Front())
+		if queue.packets.Len() == 0 {
+			// 送信待ちがなくなった citi は、次に追加されるまで対象から外す
+			sched.activeList.Remove(elem)
+			delete(sched.citiId2queue, queue.citiId)
+		}
+		return packet
+	}
+}
+
+// 送信待ちのパケット数
+func (sched *PacketScheduler) Len() int {
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	return sched.count
+}
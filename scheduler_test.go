@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+)
+
+// citi のデータパケットを生成する
+func schedPacket(citiId uint32, size int, no int) PackInfo {
+	bytes := make([]byte, size)
+	bytes[0] = byte(no)
+	return PackInfo{bytes, PACKET_KIND_NORMAL, citiId}
+}
+
+// 制御用のパケットを、データより優先して送信することを確認する
+func TestPacketSchedulerPrio(t *testing.T) {
+	sched := NewPacketScheduler()
+	sched.Push(schedPacket(CITIID_USR, BUFSIZE, 0))
+	sched.Push(PackInfo{[]byte{0}, PACKET_KIND_SYNC, CITIID_USR})
+	sched.Push(PackInfo{[]byte{1}, PACKET_KIND_NORMAL, CITIID_CTRL})
+	if sched.Len() != 3 {
+		t.Fatalf("unmatch len -- %d", sched.Len())
+	}
+
+	if packet := sched.Pop(); packet.kind != PACKET_KIND_SYNC {
+		t.Errorf("sync is not first -- %d, %d", packet.kind, packet.citiId)
+	}
+	if packet := sched.Pop(); packet.citiId != CITIID_CTRL {
+		t.Errorf("ctrl is not second -- %d, %d", packet.kind, packet.citiId)
+	}
+	if packet := sched.Pop(); packet.citiId != CITIID_USR {
+		t.Errorf("data is not last -- %d, %d", packet.kind, packet.citiId)
+	}
+	if sched.Len() != 0 {
+		t.Errorf("unmatch len -- %d", sched.Len())
+	}
+}
+
+// citi ごとの送信順を維持して、優先度の重みに応じて送信することを確認する
+func TestPacketSchedulerDRR(t *testing.T) {
+	highId := uint32(CITIID_USR)
+	lowId := uint32(CITIID_USR + 1)
+	normalId := uint32(CITIID_USR + 2)
+
+	sched := NewPacketScheduler()
+	sched.SetPriority(highId, PRIORITY_HIGH)
+	sched.SetPriority(lowId, PRIORITY_LOW)
+	// 優先度を指定しない citi は PRIORITY_NORMAL
+	num := 2 * PRIORITY_HIGH
+	for no := 0; no < num; no++ {
+		sched.Push(schedPacket(lowId, BUFSIZE, no))
+		sched.Push(schedPacket(highId, BUFSIZE, no))
+		sched.Push(schedPacket(normalId, BUFSIZE, no))
+	}
+
+	citiId2count := map[uint32]int{}
+	// 1 巡分で送信されるパケット数
+	round := PRIORITY_HIGH + PRIORITY_NORMAL + PRIORITY_LOW
+	for count := 0; count < 3*num; count++ {
+		packet := sched.Pop()
+		if int(packet.bytes[0]) != citiId2count[packet.citiId] {
+			t.Fatalf("illegal order -- %d, %d", packet.citiId, packet.bytes[0])
+		}
+		citiId2count[packet.citiId]++
+		if count == round-1 {
+			if citiId2count[highId] != PRIORITY_HIGH ||
+				citiId2count[normalId] != PRIORITY_NORMAL ||
+				citiId2count[lowId] != PRIORITY_LOW {
+				t.Errorf("unmatch weight -- %v", citiId2count)
+			}
+		}
+	}
+	if sched.Len() != 0 {
+		t.Errorf("unmatch len -- %d", sched.Len())
+	}
+}
+
+// 小さいパケットは、 1 巡でまとめて送信することを確認する
+func TestPacketSchedulerSmallPacket(t *testing.T) {
+	bigId := uint32(CITIID_USR)
+	smallId := uint32(CITIID_USR + 1)
+
+	sched := NewPacketScheduler()
+	for no := 0; no < 8; no++ {
+		if no < 4 {
+			sched.Push(schedPacket(bigId, BUFSIZE, no))
+		}
+		sched.Push(schedPacket(smallId, BUFSIZE/4-PACKET_LEN_HEADER, no))
+	}
+	citiId2count := map[uint32]int{}
+	for count := 0; count < 4; count++ {
+		citiId2count[sched.Pop().citiId]++
+	}
+	// PRIORITY_NORMAL の 1 巡で、大きいパケットは 2 つ、小さいパケットは 8 つ送れる
+	if citiId2count[bigId] != 2 || citiId2count[smallId] != 2 {
+		t.Errorf("unmatch count -- %v", citiId2count)
+	}
+	for count := 0; count < 4; count++ {
+		citiId2count[sched.Pop().citiId]++
+	}
+	if citiId2count[bigId] != 2 || citiId2count[smallId] != 6 {
+		t.Errorf("unmatch count -- %v", citiId2count)
+	}
+}
+
+// Forget() した citi は、優先度の指定がなくなることを確認する
+func TestPacketSchedulerForget(t *testing.T) {
+	sched := NewPacketScheduler()
+	sched.SetPriority(CITIID_USR, PRIORITY_HIGH)
+	sched.Forget(CITIID_USR)
+	if _, has := sched.citiId2weight[CITIID_USR]; has {
+		t.Errorf("weight is not forgotten")
+	}
+	sched.SetPriority(CITIID_USR, 0)
+	if sched.citiId2weight[CITIID_USR] != PRIORITY_NORMAL {
+		t.Errorf("default weight is not normal -- %d", sched.citiId2weight[CITIID_USR])
+	}
+}
+
+// citi のキューが一杯の場合は、 Pop() されるまで Push() を待つことを確認する
+func TestPacketSchedulerQueueFull(t *testing.T) {
+	sched := NewPacketScheduler()
+	for no := 0; no < CITI_QUEUE_NUM; no++ {
+		sched.Push(schedPacket(CITIID_USR, 1, no))
+	}
+	pushed := make(chan bool)
+	go func() {
+		sched.Push(schedPacket(CITIID_USR, 1, CITI_QUEUE_NUM))
+		pushed <- true
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push to full queue")
+	default:
+	}
+	sched.Pop()
+	<-pushed
+	if sched.Len() != CITI_QUEUE_NUM {
+		t.Errorf("unmatch len -- %d", sched.Len())
+	}
+}
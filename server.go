@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -124,15 +125,43 @@ func StartHeavyClient(serverInfo HostInfo) {
 	}
 }
 
+// tcp の接続を 1 つ受け付ける
+//
+// @return bool 待ち受けを続ける場合 true
 func listenTcpServer(
 	local net.Listener, param *TunnelParam, forwardList []ForwardInfo,
-	process func(connInfo *ConnInfo)) {
+	process func(connInfo *ConnInfo)) bool {
 	conn, err := local.Accept()
 	if err != nil {
-		log.Fatal(err)
+		if errors.Is(err, net.ErrClosed) {
+			return false
+		}
+		// 一時的なエラーで、処理中のセッションを止めないように受け付け直す
+		log.Printf("failed to accept -- %s", err)
+		countError(ERROR_KIND_ACCEPT)
+		time.Sleep(ACCEPT_RETRY_INTERVAL)
+		return true
 	}
+	// 認証やセッションの処理中も次の接続を受け付けられるように、別 goroutine で処理する
+	go processTcpClient(conn, param, forwardList, process)
+	return true
+}
+
+// tcp で接続してきたクライアントを処理する
+//
+// @param conn クライアントとのコネクション
+// @param process 新しいセッションの処理
+func processTcpClient(
+	conn net.Conn, param *TunnelParam, forwardList []ForwardInfo,
+	process func(connInfo *ConnInfo)) {
 	defer conn.Close()
 
+	// PROXY protocol のヘッダを待つ間も、他の接続を止めないようにここで読み込む
+	conn, err := readProxyProtoConn(conn, param)
+	if err != nil {
+		return
+	}
+
 	remoteAddr := fmt.Sprintf("%s", conn.RemoteAddr())
 	log.Print("connected -- ", remoteAddr)
 	if err := AcceptClient(remoteAddr, param); err != nil {
@@ -145,9 +174,8 @@ func listenTcpServer(
 	tunnelParam := *param
 	connInfo := CreateConnInfo(
 		conn, tunnelParam.encPass, tunnelParam.encCount, nil, true)
-	newSession := false
 	remoteAddrTxt := fmt.Sprintf("%s", conn.RemoteAddr())
-	if newSession, err = ProcessServerAuth(
+	if newSession, err := ProcessServerAuth(
 		connInfo, &tunnelParam, remoteAddrTxt, forwardList); err != nil {
 		connInfo.SessionInfo.SetState(Session_state_authmiss)
 
@@ -156,6 +184,10 @@ func listenTcpServer(
 	} else {
 		if newSession {
 			process(connInfo)
+		} else {
+			// 再接続の場合は、既に処理中のセッションがこのコネクションを使うので、
+			// そのセッションでコネクションが開放されるまで close しない
+			JoinUntilToCloseConn(conn)
 		}
 	}
 }
@@ -169,10 +201,12 @@ func StartServer(param *TunnelParam, forwardList []ForwardInfo) {
 	defer local.Close()
 
 	for {
-		listenTcpServer(local, param, forwardList,
+		if !listenTcpServer(local, param, forwardList,
 			func(connInfo *ConnInfo) {
 				NewConnectFromWith(connInfo, param, GetSessionConn)
-			})
+			}) {
+			break
+		}
 	}
 }
 
@@ -184,15 +218,21 @@ func StartReverseServer(param *TunnelParam, forwardList []ForwardInfo) {
 	}
 	defer local.Close()
 
-	listenGroup := NewListen(forwardList)
+	listenGroup, err := NewListen(forwardList)
+	if err != nil {
+		log.Printf("failed to listen -- %s", err)
+		return
+	}
 	defer listenGroup.Close()
 
 	for {
-		go listenTcpServer(local, param, forwardList,
+		if !listenTcpServer(local, param, forwardList,
 			func(connInfo *ConnInfo) {
 				ListenNewConnect(
 					listenGroup, connInfo, param, false, GetSessionConn)
-			})
+			}) {
+			break
+		}
 	}
 }
 
@@ -203,17 +243,18 @@ type WrapWSHandler struct {
 
 func (handler WrapWSHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
-	if err := AcceptClient(req.RemoteAddr, handler.param); err != nil {
+	remoteAddr := getHttpClientAddr(req, handler.param)
+	if err := AcceptClient(remoteAddr, handler.param); err != nil {
 		log.Printf("reject -- %s", err)
 		w.WriteHeader(http.StatusNotAcceptable)
 		//fmt.Fprintf( w, "%v\n", err )
 		time.Sleep(3 * time.Second)
 		return
 	}
-	defer ReleaseClient(req.RemoteAddr)
+	defer ReleaseClient(remoteAddr)
 
 	wrap := func(ws *websocket.Conn) {
-		handler.handle(ws, req.RemoteAddr)
+		handler.handle(ws, remoteAddr)
 	}
 
 	wshandler := websocket.Handler(wrap)
@@ -243,7 +284,11 @@ func execWebSocketServer(
 	wrapHandler := WrapWSHandler{handle, &param}
 
 	http.Handle("/", wrapHandler)
-	err := http.ListenAndServe(param.serverInfo.toStr(), nil)
+	local, err := net.Listen("tcp", param.serverInfo.toStr())
+	if err != nil {
+		panic("ListenAndServe: " + err.Error())
+	}
+	err = http.Serve(wrapProxyProtoListener(local, &param), nil)
 	if err != nil {
 		panic("ListenAndServe: " + err.Error())
 	}
@@ -262,7 +307,11 @@ func StartWebsocketServer(param *TunnelParam, forwardList []ForwardInfo) {
 func StartReverseWebSocketServer(param *TunnelParam, forwardList []ForwardInfo) {
 	log.Print("start reverse websocket -- ", param.serverInfo.toStr())
 
-	listenGroup := NewListen(forwardList)
+	listenGroup, err := NewListen(forwardList)
+	if err != nil {
+		log.Printf("failed to listen -- %s", err)
+		return
+	}
 	defer listenGroup.Close()
 
 	execWebSocketServer(
@@ -7,6 +7,7 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -33,12 +34,52 @@ func (lock *Lock) rel() {
 	lock.mutex.Unlock()
 }
 
+// 状態の変化の通知
+//
+// 待つ側は、状態を確認する前に wait() でチャネルを取得し、
+// 条件を満たしていなければ、そのチャネルが close されるまで待つ。
+// 状態を変更した側は notify() で、待っている全ての goroutine を起こす。
+type stateNotifier struct {
+	mutex sync.Mutex
+	// 次の notify() で close するチャネル
+	ch chan struct{}
+}
+
+// 状態の変化を待つチャネルを取得する
+func (notifier *stateNotifier) wait() <-chan struct{} {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+
+	if notifier.ch == nil {
+		notifier.ch = make(chan struct{})
+	}
+	return notifier.ch
+}
+
+// 状態の変化を通知する
+func (notifier *stateNotifier) notify() {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+
+	if notifier.ch != nil {
+		close(notifier.ch)
+		notifier.ch = nil
+	}
+}
+
 // tunnel 上に通す tcp の組み合わせ
 type ForwardInfo struct {
 	// listen する host:port
 	Src HostInfo
 	// forward する相手の host:port
 	Dst HostInfo
+	// Dst に接続した際に送る PROXY protocol のバージョン。
+	// 0 の場合は送らない。
+	ProxyProtocol int
+	// この forward の通信の圧縮方式。 "" の場合はセッションの設定に従う。
+	Compress string
+	// この forward の通信の送信優先度 PRIORITY_*。 0 の場合は PRIORITY_NORMAL。
+	Priority int
 }
 
 // tunnel の制御パラメータ
@@ -47,9 +88,9 @@ type TunnelParam struct {
 	pass *string
 	// セッションのモード
 	Mode string
-	// 接続可能な IP パターン。
+	// 接続可能な IP のルール。
 	// nil の場合、 IP 制限しない。
-	maskedIP *MaskIP
+	ipFilter *IPFilter
 	// セッションの通信を暗号化するパスワード
 	encPass *string
 	// セッションの通信を暗号化する通信数。
@@ -65,6 +106,45 @@ type TunnelParam struct {
 	ctrl int
 	// サーバ情報
 	serverInfo HostInfo
+	// 接続元クライアントの制限
+	clientLimit ClientLimit
+	// 信頼する proxy (ロードバランサ) のアドレスリスト
+	trustedProxyList []*MaskIP
+	// 信頼する proxy からの接続で PROXY protocol を受け付ける場合 true
+	proxyProtocol bool
+	// 暗号鍵を更新するまでの送信サイズ (byte)。 0 の場合はサイズで更新しない。
+	rekeySize int64
+	// 暗号鍵を更新するまでの時間。 0 の場合は時間で更新しない。
+	rekeyInterval time.Duration
+	// 認証処理のタイムアウト。 0 の場合はタイムアウトしない。
+	authTimeout time.Duration
+	// 1 フレームの最大データサイズ
+	maxFrameSize int
+	// セッション全体の通信の圧縮方式。 "" の場合は圧縮しない。
+	compress string
+	// このサイズ未満のパケットは圧縮しない
+	compMin int
+	// 接続先への接続タイムアウト。 0 の場合は OS の設定に従う。
+	dialTimeout time.Duration
+	// tunnel 再接続中の新しい接続の扱い RECONNECT_MODE_*
+	reconnectMode string
+	// フロー制御のウィンドウサイズ (byte)
+	window int
+	// RTT と転送量からウィンドウサイズを自動調整する場合 true
+	windowAuto bool
+	// keep alive の間隔の何倍の間、相手から受信がなければ切断とみなすか。
+	// 0 の場合は判定しない。
+	deadCount int
+	// 再接続の方針
+	reconnectPolicy ReconnectPolicy
+	// 切断したセッションの再接続を待つ時間。
+	// これを過ぎたセッションは破棄する。 0 の場合は破棄しない。
+	resumeGrace time.Duration
+	// SIGTERM を受けた場合に、 citi の終了を待つ最大時間
+	drainTimeout time.Duration
+	// セッションの citi のリングバッファのサイズの合計の上限 (byte)。
+	// 0 の場合は制限しない。
+	sessionBufMax int64
 }
 
 // セッションの再接続時に、
@@ -81,9 +161,7 @@ const CITIID_USR = 1
 
 const CTRL_HEADER = 0
 const CTRL_RESP_HEADER = 1
-
-// 再接続後の CryptCtrlObj を同じものを使えるようにするまで true には出来ない
-const PRE_ENC = false
+const CTRL_REKEY = 2
 
 type DummyConn struct {
 }
@@ -129,11 +207,34 @@ func (ringBuf *RingBuf) getCur() []byte {
 type ConnHeader struct {
 	HostInfo HostInfo
 	CitiId   uint32
+	// HostInfo に接続した際に送る PROXY protocol のバージョン。 0 の場合は送らない。
+	ProxyProtocol int
+	// listen 側に接続してきた元のアドレス
+	SrcAddr string
+	// listen 側で接続を受けたアドレス
+	ListenAddr string
+	// この接続の通信の圧縮方式。 "" の場合は圧縮しない。
+	Compress string
+	// この接続の通信の送信優先度 PRIORITY_*
+	Priority int
 }
 type CtrlRespHeader struct {
 	Result bool
 	Mess   string
 	CitiId uint32
+	// 失敗した場合の理由 CLOSE_REASON_*
+	Reason byte
+}
+
+// 終了済みの citi の ID を保持しておく数
+const CLOSED_CITI_NUM = 1024
+
+// 暗号鍵の更新通知
+//
+// この通知以降のパケットは、 Nonce から生成した鍵で暗号化する。
+type CtrlRekey struct {
+	// 鍵更新用の乱数 (base64)
+	Nonce string
 }
 
 type CtrlInfo struct {
@@ -150,12 +251,18 @@ type ConnInTunnelInfo struct {
 	// フロー制御用 channel
 	syncChan chan int64
 
+	// バイト単位の送信のフロー制御。
+	// nil の場合は PACKET_NUM_BASE 単位でフロー制御する。
+	flow *FlowCtrl
+
 	// WritePackList に送り直すパケットを保持するため、
 	// パケットのバッファをリンクで保持しておく。
 	// write 用バッファ。
 	ringBufW *RingBuf
 	// Read 用バッファ。
 	ringBufR *RingBuf
+	// ringBufW と ringBufR のサイズの合計 (byte)
+	ringBufSize int64
 
 	// このセッションで read したパケットの数
 	ReadNo int64
@@ -163,9 +270,21 @@ type ConnInTunnelInfo struct {
 	WriteNo   int64
 	ReadSize  int64
 	WriteSize int64
+	// 最後に SYNC で通知した ReadSize と ReadNo
+	syncedSize int64
+	syncedNo   int64
 
 	respHeader chan *CtrlRespHeader
 
+	// 通信の圧縮処理。 nil の場合は圧縮しない。
+	comp *CitiCompressor
+
+	// half-close をサポートする場合 true。
+	// true の場合、送信と受信の終了を別々に扱う。
+	halfClose bool
+	// citi を中断している場合 true
+	closing bool
+
 	ReadState  int
 	WriteState int
 
@@ -193,10 +312,27 @@ type SessionInfo struct {
 	// セッションを識別する ID
 	SessionId    int
 	SessionToken string
-
-	// packet 書き込み用 channel
-	packChan    chan PackInfo
+	// 再接続時の証明に使う秘密情報。
+	// 認証時の鍵交換で生成し、通信路には流さない。
+	sessionSecret []byte
+	// 認証時にネゴシエーションして確定した機能
+	caps *Capability
+	// 認証時に確定した forward の設定。
+	// 接続側は、ここで PROXY protocol が指定されている接続先にだけヘッダを送る。
+	forwardList []ForwardInfo
+	// caps で確定したフレーム形式
+	frameFormat *FrameFormat
+	// citi のリングバッファのパケット数。
+	// WritePackList もこの数だけ保持する。
+	ringNum int
+
+	// packet 書き込み用のスケジューラ
+	packSched *PacketScheduler
+	// packetEncrypter() で暗号化済みのパケット
 	packChanEnc chan PackInfo
+	// セッションの暗号処理。
+	// nil の場合は、コネクションの CryptCtrlObj で暗号化する。
+	crypt *SessionCrypt
 
 	// pipe から読み取ったサイズ
 	readSize int64
@@ -212,7 +348,7 @@ type SessionInfo struct {
 	WriteNo int64
 
 	// 送信した SessionPacket のリスト。
-	// 直近 PACKET_NUM 分の SessionPacket を保持する。
+	// 直近 ringNum 分の SessionPacket を保持する。
 	WritePackList *list.List
 
 	// 送り直すパケット番号。
@@ -225,8 +361,33 @@ type SessionInfo struct {
 
 	isTunnelServer bool
 
-	ringBufEnc  *RingBuf
-	encSyncChan chan bool
+	// 終了済みの citi の ID。
+	// 終了後に届いたパケットを、ログを出さずに読み捨てるために使う。
+	closedCitiIds  map[uint32]bool
+	closedCitiList *list.List
+	// 読み捨てたパケットの数
+	discardCount int64
+	// シーケンス番号が重複していたパケットの数
+	dupCount int64
+	// シーケンス番号が飛んでいたパケットの数
+	gapCount int64
+	// 再開できなくなったセッションの理由。 "" の場合は再開できる。
+	resetReason string
+	// tunnel の読み書きの期限。
+	// この時間、相手から受信がないか書き込みが終わらない場合、
+	// 相手が応答しないものとして再接続する。 0 の場合は期限なし。
+	aliveTimeout time.Duration
+	// 再接続を待つ時間。 TunnelParam.resumeGrace と同じ。
+	resumeGrace time.Duration
+	// citi のリングバッファのサイズの合計 (byte)
+	ringBufSize int64
+	// ringBufSize の上限。 TunnelParam.sessionBufMax と同じ。 0 の場合は制限しない。
+	ringBufMax int64
+	// terminate() でセッションを終了する場合 true。
+	// packetWriter() は、 EOS を相手にも送信してから終了する。
+	terminating bool
+	// packetWriter() が終了したら close する
+	writerEnd chan struct{}
 
 	packetWriterWaitTime time.Duration
 
@@ -237,41 +398,111 @@ type SessionInfo struct {
 	// 0: 待ち無し, 1: read or write どちらかで待ち,  2: read/write 両方で待ち
 	reconnetWaitState int
 
+	// 状態の変化の通知。
+	// Session_state_* の変化、コネクションの登録・開放、再接続の待ち状態の変化、
+	// リセットで通知する。
+	notifier stateNotifier
+
 	releaseChan chan bool
 
 	// この構造体のメンバアクセス排他用 mutex
 	mutex *Lock
 }
 
-func (sessionInfo *SessionInfo) GetPacketBuf(citiId uint32, packSize uint16) []byte {
+func (sessionInfo *SessionInfo) GetPacketBuf(citiId uint32, packSize int) []byte {
 	if citiId >= CITIID_USR {
 		if citi := sessionInfo.getCiti(citiId); citi != nil {
 			buf := citi.ringBufR.getCur()
-			if len(buf) < int(packSize) {
-				log.Fatal("illegal packet size -- ", len(buf))
+			if len(buf) >= packSize {
+				return buf[:packSize]
 			}
-			return buf[:packSize]
+			// ReadItem() でフレームサイズを確認しているので、ここには来ない
+			log.Printf("illegal packet size -- %d < %d", len(buf), packSize)
 		}
 	}
 	return make([]byte, packSize)
 }
 
+// 再接続できるセッションかどうか
+//
+// 旧バージョンの相手とのセッションは秘密情報を共有していないので、
+// token だけで乗っ取られないように再接続しない。
+func (sessionInfo *SessionInfo) canResume() bool {
+	return len(sessionInfo.sessionSecret) > 0
+}
+
+// ネゴシエーションで確定した機能を設定する
+func (sessionInfo *SessionInfo) setCaps(caps *Capability) {
+	sessionInfo.caps = caps
+	sessionInfo.frameFormat = newFrameFormat(caps)
+	sessionInfo.packSched.SetFrameSize(sessionInfo.frameFormat.maxSize)
+	sessionInfo.ringNum = PACKET_NUM
+	if sessionInfo.frameFormat.byteWindow {
+		sessionInfo.ringNum = window2RingNum(
+			caps.Window, sessionInfo.frameFormat.maxSize)
+	}
+}
+
+// セッションの暗号処理を設定する
+//
+// 新規セッションの認証時に、 sessionSecret と caps を設定した後で呼び出す。
+// 相手が FEATURE_SESSION_CIPHER をサポートしていない場合は、
+// 従来通りコネクションの CryptCtrlObj で暗号化する。
+func (sessionInfo *SessionInfo) setupCrypt(param *TunnelParam) {
+	caps := sessionInfo.caps
+	if caps == nil || !caps.hasFeature(FEATURE_SESSION_CIPHER) ||
+		len(caps.Ciphers) == 0 || caps.Ciphers[0] == CIPHER_NONE {
+		return
+	}
+	sessionInfo.crypt = NewSessionCrypt(
+		param.encPass, param.encCount, sessionInfo.sessionSecret,
+		sessionInfo.isTunnelServer)
+}
+
+// citi の送信のフロー制御を生成する
+//
+// @param param TunnelParam
+// @return *FlowCtrl バイト単位でフロー制御しない場合は nil
+func (sessionInfo *SessionInfo) newFlowCtrl(param *TunnelParam) *FlowCtrl {
+	if !sessionInfo.frameFormat.byteWindow {
+		return nil
+	}
+	return NewFlowCtrl(
+		int64(sessionInfo.caps.Window),
+		ringNum2InflightMax(sessionInfo.ringNum), param.windowAuto)
+}
+
+// SYNC を返すかどうか
+//
+// 処理済みのデータがウィンドウの 1/SYNC_DIV を越えた場合に返す。
+// また、受信済みのデータを全て処理した場合は、
+// 相手が送信を待っている可能性があるので早めに返す。
+func (sessionInfo *SessionInfo) needSync(citi *ConnInTunnelInfo) bool {
+	unsyncedSize := citi.ReadSize - citi.syncedSize
+	unsyncedNo := citi.ReadNo - citi.syncedNo
+	if unsyncedNo == 0 {
+		return false
+	}
+	if unsyncedSize >= int64(sessionInfo.caps.Window/SYNC_DIV) ||
+		unsyncedNo >= ringNum2InflightMax(sessionInfo.ringNum)/SYNC_DIV {
+		return true
+	}
+	return len(citi.readPackChan) == 0 && unsyncedSize >= MIN_WINDOW/SYNC_DIV
+}
+
 func (sessionInfo *SessionInfo) SetState(state string) {
 	sessionInfo.state = state
+	sessionInfo.notifier.notify()
 }
 
 func (sessionInfo *SessionInfo) Setup() {
 	for count := uint32(0); count < CITIID_USR; count++ {
-		sessionInfo.citiId2Info[count] = NewConnInTunnelInfo(nil, count)
+		sessionInfo.citiId2Info[count] = NewConnInTunnelInfo(nil, count, 0, PACKET_NUM)
 	}
 
 	sessionInfo.ctrlInfo.waitHeaderCount = make(chan int, 100)
 	sessionInfo.ctrlInfo.header = make(chan *ConnHeader, 1)
 	//sessionInfo.ctrlInfo.respHeader = make(chan *CtrlRespHeader,1)
-
-	for count := 0; count < PACKET_NUM_DIV; count++ {
-		sessionInfo.encSyncChan <- true
-	}
 }
 
 func newEmptySessionInfo(
@@ -279,7 +510,7 @@ func newEmptySessionInfo(
 	sessionInfo := &SessionInfo{
 		SessionId:            sessionId,
 		SessionToken:         token,
-		packChan:             make(chan PackInfo, PACKET_NUM),
+		packSched:            NewPacketScheduler(),
 		packChanEnc:          make(chan PackInfo, PACKET_NUM),
 		readSize:             0,
 		wroteSize:            0,
@@ -292,13 +523,16 @@ func newEmptySessionInfo(
 		ctrlInfo:             CtrlInfo{},
 		state:                "None",
 		isTunnelServer:       isTunnelServer,
-		ringBufEnc:           NewRingBuf(PACKET_NUM, BUFSIZE),
-		encSyncChan:          make(chan bool, PACKET_NUM_DIV),
+		frameFormat:          legacyFrameFormat,
+		ringNum:              PACKET_NUM,
+		closedCitiIds:        map[uint32]bool{},
+		closedCitiList:       new(list.List),
 		packetWriterWaitTime: 0,
 		readState:            0,
 		writeState:           0,
 		reconnetWaitState:    0,
 		releaseChan:          make(chan bool, 3),
+		writerEnd:            make(chan struct{}),
 		mutex:                &Lock{},
 	}
 
@@ -314,22 +548,31 @@ func DumpSession(stream io.Writer) {
 
 	fmt.Fprintf(stream, "------------\n")
 	fmt.Fprintf(stream, "sessionMgr.mutex: %s\n", sessionMgr.mutex.owner)
+	fmt.Fprintf(stream, "session reset: %d\n", sessionMgr.resetCount)
+	fmt.Fprintf(stream, "session free: %d\n", sessionMgr.freeCount)
+	fmt.Fprintf(
+		stream, "error: ctrl %d, frame %d, accept %d, listen %d, citi %d\n",
+		sessionMgr.error2count[ERROR_KIND_CTRL], sessionMgr.error2count[ERROR_KIND_FRAME],
+		sessionMgr.error2count[ERROR_KIND_ACCEPT], sessionMgr.error2count[ERROR_KIND_LISTEN],
+		sessionMgr.error2count[ERROR_KIND_CITI])
 	for _, sessionInfo := range sessionMgr.sessionToken2info {
 		fmt.Fprintf(stream, "sessionId: %d\n", sessionInfo.SessionId)
-		fmt.Fprintf(stream, "token: %s\n", sessionInfo.SessionToken)
 		fmt.Fprintf(stream, "state: %s\n", sessionInfo.state)
 		fmt.Fprintf(stream, "mutex onwer: %s\n", sessionInfo.mutex.owner)
 		fmt.Fprintf(
 			stream, "WriteNo, ReadNo: %d %d\n",
 			sessionInfo.WriteNo, sessionInfo.ReadNo)
-		fmt.Fprintf(stream, "packChan: %d\n", len(sessionInfo.packChan))
+		fmt.Fprintf(stream, "packSched: %d\n", sessionInfo.packSched.Len())
 		fmt.Fprintf(stream, "packChanEnc: %d\n", len(sessionInfo.packChanEnc))
-		fmt.Fprintf(stream, "encSyncChan: %d\n", len(sessionInfo.encSyncChan))
 		fmt.Fprintf(stream, "releaseChan: %d\n", len(sessionInfo.releaseChan))
 		fmt.Fprintf(
 			stream, "writeSize, ReadSize: %d, %d\n",
 			sessionInfo.wroteSize, sessionInfo.readSize)
 		fmt.Fprintf(stream, "citiId2Info: %d\n", len(sessionInfo.citiId2Info))
+		fmt.Fprintf(stream, "discard packet: %d\n", sessionInfo.discardCount)
+		fmt.Fprintf(
+			stream, "duplicated packet: %d, sequence gap: %d\n",
+			sessionInfo.dupCount, sessionInfo.gapCount)
 		fmt.Fprintf(
 			stream, "readState %d, writeState %d\n",
 			sessionInfo.readState, sessionInfo.writeState)
@@ -343,6 +586,9 @@ func DumpSession(stream io.Writer) {
 			fmt.Fprintf(
 				stream, "syncChan: %d, readPackChan %d, readNo %d, writeNo %d\n",
 				len(citi.syncChan), len(citi.readPackChan), citi.ReadNo, citi.WriteNo)
+			if citi.flow != nil {
+				fmt.Fprintf(stream, "flow: %s\n", citi.flow)
+			}
 		}
 
 		fmt.Fprintf(stream, "------------\n")
@@ -368,29 +614,44 @@ func NewSessionInfo(isTunnelServer bool) *SessionInfo {
 	return sessionInfo
 }
 
-func (sessionInfo *SessionInfo) UpdateSessionId(sessionId int, token string) {
+func (sessionInfo *SessionInfo) UpdateSessionId(
+	sessionId int, token string, secret []byte, caps *Capability) {
 	sessionMgr.mutex.get("UpdateSessionId")
 	defer sessionMgr.mutex.rel()
 
 	sessionInfo.SessionId = sessionId
 	sessionInfo.SessionToken = token
+	sessionInfo.sessionSecret = secret
+	sessionInfo.setCaps(caps)
 	sessionMgr.sessionToken2info[sessionInfo.SessionToken] = sessionInfo
 }
 
-func NewConnInTunnelInfo(conn io.ReadWriteCloser, citiId uint32) *ConnInTunnelInfo {
+// @param bufSize リングバッファの 1 パケットのサイズ。フレームの最大サイズに合わせる。
+// @param ringNum リングバッファのパケット数。ウィンドウに合わせる。
+func NewConnInTunnelInfo(
+	conn io.ReadWriteCloser, citiId uint32, bufSize int, ringNum int) *ConnInTunnelInfo {
+	var ringBufW, ringBufR *RingBuf
+	if citiId >= CITIID_USR {
+		// 制御用の citi はリングバッファを使わないので、
+		// 認証前のセッションでバッファを確保しないように、 USR の citi だけ確保する。
+		ringBufW = NewRingBuf(ringNum, bufSize)
+		ringBufR = NewRingBuf(ringNum, bufSize)
+	}
 	citi := &ConnInTunnelInfo{
 		conn:         conn,
 		citiId:       citiId,
-		readPackChan: make(chan []byte, PACKET_NUM),
+		readPackChan: make(chan []byte, ringNum),
 		end:          false,
 		syncChan:     make(chan int64, PACKET_NUM_DIV),
-		ringBufW:     NewRingBuf(PACKET_NUM, BUFSIZE),
-		ringBufR:     NewRingBuf(PACKET_NUM, BUFSIZE),
+		ringBufW:     ringBufW,
+		ringBufR:     ringBufR,
 		ReadNo:       0,
 		WriteNo:      0,
 		ReadSize:     0,
 		WriteSize:    0,
-		respHeader:   make(chan *CtrlRespHeader),
+		// タイムアウト後に届いた応答で packetReader が止まらないように、
+		// バッファを持たせる
+		respHeader:   make(chan *CtrlRespHeader, 1),
 		ReadState:    0,
 		WriteState:   0,
 		waitTimeInfo: WaitTimeInfo{},
@@ -412,27 +673,46 @@ func (sessionInfo *SessionInfo) getHeader() *ConnHeader {
 	return header
 }
 
-func (info *SessionInfo) addCiti(conn io.ReadWriteCloser, citiId uint32) *ConnInTunnelInfo {
+// citi を登録する
+//
+// @param conn citi の接続
+// @param citiId citi の ID。 CITIID_CTRL の場合は新しい ID を割り当てる。
+// @return *ConnInTunnelInfo 登録した citi
+// @return error citi の ID を割り当てられない場合
+func (info *SessionInfo) addCiti(
+	conn io.ReadWriteCloser, citiId uint32) (*ConnInTunnelInfo, error) {
 	sessionMgr.mutex.get("addCiti")
 	defer sessionMgr.mutex.rel()
 
 	if citiId == CITIID_CTRL {
+		if info.nextCtitId+1 <= CITIID_USR {
+			// ID を使い切ったので、このセッションではこれ以上 citi を作れない
+			return nil, fmt.Errorf("citiId is overflow -- session %d", info.SessionId)
+		}
 		citiId = info.nextCtitId
 		info.nextCtitId++
-		if info.nextCtitId <= CITIID_USR {
-			log.Fatal("info.nextCtitId is overflow")
-		}
 	}
 
 	citi, has := info.citiId2Info[citiId]
 	if has {
 		log.Printf("has Citi -- %d %d", info.SessionId, citiId)
-		return citi
+		return citi, nil
 	}
-	citi = NewConnInTunnelInfo(conn, citiId)
+	// リングバッファは送信用と受信用の 2 つ
+	ringBufSize := int64(info.frameFormat.maxSize) * int64(info.ringNum) * 2
+	if info.ringBufMax > 0 && info.ringBufSize+ringBufSize > info.ringBufMax {
+		// 大きいフレームで多数の citi を作って、メモリを使い切らないようにする
+		return nil, fmt.Errorf(
+			"over session buffer -- session %d, %d + %d > %d",
+			info.SessionId, info.ringBufSize, ringBufSize, info.ringBufMax)
+	}
+	citi = NewConnInTunnelInfo(conn, citiId, info.frameFormat.maxSize, info.ringNum)
+	citi.halfClose = info.caps.hasFeature(FEATURE_HALF_CLOSE)
+	citi.ringBufSize = ringBufSize
+	info.ringBufSize += ringBufSize
 	info.citiId2Info[citiId] = citi
 	log.Printf("addCiti -- %d %d %d", info.SessionId, citiId, len(info.citiId2Info))
-	return citi
+	return citi, nil
 }
 
 func (info *SessionInfo) getCiti(citiId uint32) *ConnInTunnelInfo {
@@ -445,11 +725,34 @@ func (info *SessionInfo) getCiti(citiId uint32) *ConnInTunnelInfo {
 	return nil
 }
 
+// citiId が使用中か、使用済みかどうか
+func (info *SessionInfo) isUsedCitiId(citiId uint32) bool {
+	sessionMgr.mutex.get("isUsedCitiId")
+	defer sessionMgr.mutex.rel()
+
+	if _, has := info.citiId2Info[citiId]; has {
+		return true
+	}
+	return info.closedCitiIds[citiId]
+}
+
 func (info *SessionInfo) delCiti(citi *ConnInTunnelInfo) {
 	sessionMgr.mutex.get("delCiti")
 	defer sessionMgr.mutex.rel()
 
+	if info.citiId2Info[citi.citiId] == citi {
+		info.ringBufSize -= citi.ringBufSize
+	}
 	delete(info.citiId2Info, citi.citiId)
+	info.packSched.Forget(citi.citiId)
+
+	// 終了後に届くパケットのために、終了した citi の ID を残しておく
+	info.closedCitiIds[citi.citiId] = true
+	info.closedCitiList.PushBack(citi.citiId)
+	if info.closedCitiList.Len() > CLOSED_CITI_NUM {
+		oldId := info.closedCitiList.Remove(info.closedCitiList.Front()).(uint32)
+		delete(info.closedCitiIds, oldId)
+	}
 
 	log.Printf(
 		"delCiti -- %d %d %d", info.SessionId, citi.citiId, len(info.citiId2Info))
@@ -461,6 +764,176 @@ func (info *SessionInfo) delCiti(citi *ConnInTunnelInfo) {
 	}
 }
 
+// 相手から受けた citi の終了通知を処理する
+//
+// @param citiId 終了する citi
+// @param body PACKET_KIND_CLOSE のデータ
+func (info *SessionInfo) recvClose(citiId uint32, body []byte) {
+	citi := info.getCiti(citiId)
+	if citi == nil || citi.end {
+		info.discardPacket(citiId, "close")
+		return
+	}
+	how, reason := body[0], body[1]
+	switch how {
+	case CLOSE_HOW_WRITE:
+		// 相手の書き込みが終了したことを、データと同じ順番で tunnel2Stream に伝える
+		citi.readPackChan <- make([]byte, 0)
+	case CLOSE_HOW_RESET:
+		log.Printf(
+			"reset by peer -- %d-%d, %s",
+			info.SessionId, citiId, closeReason2str(reason))
+		citi.abort(info)
+		citi.readPackChan <- make([]byte, 0)
+	default:
+		log.Printf("illegal close -- %d, %d", citiId, how)
+	}
+}
+
+// citi の通信を中断する
+//
+// ローカルの接続は RST で切断する。
+//
+// @param sessionInfo セッション
+// @return bool 既に中断している場合 false
+func (citi *ConnInTunnelInfo) abort(sessionInfo *SessionInfo) bool {
+	sessionInfo.mutex.get("abort")
+	closing := citi.closing
+	citi.closing = true
+	conn := citi.conn
+	sessionInfo.mutex.rel()
+
+	if closing {
+		return false
+	}
+	if conn != nil {
+		resetConn(conn)
+	}
+	// stream2Tunnel() が SYNC 待ちになっている可能性があるので、通知してやる
+	select {
+	case citi.syncChan <- 0:
+	default:
+	}
+	return true
+}
+
+// 接続結果を渡す
+//
+// @param sessionInfo セッション
+// @param resp 接続結果
+// @return bool 接続結果の待ちが中断されている場合 false
+func (citi *ConnInTunnelInfo) putResp(sessionInfo *SessionInfo, resp *CtrlRespHeader) bool {
+	sessionInfo.mutex.get("putResp")
+	defer sessionInfo.mutex.rel()
+	if citi.closing {
+		return false
+	}
+	citi.respHeader <- resp
+	return true
+}
+
+// 接続結果の待ちを中断する
+//
+// @param sessionInfo セッション
+// @return *CtrlRespHeader 既に接続結果が届いている場合はその結果。それ以外は nil。
+func (citi *ConnInTunnelInfo) cancelWaitResp(sessionInfo *SessionInfo) *CtrlRespHeader {
+	sessionInfo.mutex.get("cancelWaitResp")
+	defer sessionInfo.mutex.rel()
+	select {
+	case resp := <-citi.respHeader:
+		return resp
+	default:
+	}
+	citi.closing = true
+	return nil
+}
+
+// 接続結果の待ちを中断した citi に、遅れて届いた接続結果を処理する
+//
+// 相手が接続していた場合は、その接続を切断させる。
+//
+// @param citi 接続結果の待ちを中断した citi
+// @param resp 接続結果
+func (sessionInfo *SessionInfo) closeCanceledCiti(
+	citi *ConnInTunnelInfo, resp *CtrlRespHeader) {
+	if resp.Result {
+		log.Printf(
+			"close the connection after timeout -- %d-%d",
+			sessionInfo.SessionId, citi.citiId)
+		if !citi.halfClose {
+			// 中断を通知できない相手には、入力元が切れた時と同じ 0 バイトデータを送る。
+			// half-close をサポートする相手には、タイムアウト時に中断を通知済み。
+			sessionInfo.packSched.Push(
+				PackInfo{make([]byte, 0), PACKET_KIND_NORMAL, citi.citiId})
+		}
+	}
+	sessionInfo.delCiti(citi)
+}
+
+// citi を中断しているか
+func (citi *ConnInTunnelInfo) isClosing(sessionInfo *SessionInfo) bool {
+	sessionInfo.mutex.get("isClosing")
+	defer sessionInfo.mutex.rel()
+	return citi.closing
+}
+
+// citi の通信を中断し、相手にも通知する
+//
+// @param sessionInfo セッション
+// @param reason 中断理由 CLOSE_REASON_*
+func (citi *ConnInTunnelInfo) abortWithNotify(sessionInfo *SessionInfo, reason byte) {
+	if !citi.abort(sessionInfo) {
+		return
+	}
+	log.Printf(
+		"reset -- %d-%d, %s",
+		sessionInfo.SessionId, citi.citiId, closeReason2str(reason))
+	sessionInfo.packSched.Push(PackInfo{
+		[]byte{CLOSE_HOW_RESET, reason}, PACKET_KIND_CLOSE, citi.citiId})
+}
+
+// 接続を RST で切断する
+//
+// conn が linger を設定できない場合は、通常の close を行なう。
+func resetConn(conn io.ReadWriteCloser) {
+	if lingerConn, ok := conn.(interface{ SetLinger(sec int) error }); ok {
+		// linger を 0 にして close すると、 FIN ではなく RST を送る
+		lingerConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// 書き込み側だけを終了する
+//
+// conn が half-close をサポートしない場合は、 close する。
+func closeWrite(conn io.ReadWriteCloser) {
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+		if err := closer.CloseWrite(); err != nil {
+			log.Printf("failed to CloseWrite -- %s", err)
+		}
+		return
+	}
+	conn.Close()
+}
+
+// 存在しない citi 宛のパケットを読み捨てる
+//
+// 終了直後の citi 宛には、相手が終了を知る前に送ったパケットが届くので、
+// 終了済みの citi 宛の場合はログを出さずに数だけ数える。
+//
+// @param citiId パケットの宛先
+// @param txt ログ用の文字列
+func (info *SessionInfo) discardPacket(citiId uint32, txt string) {
+	sessionMgr.mutex.get("discardPacket")
+	defer sessionMgr.mutex.rel()
+
+	info.discardCount++
+	if info.closedCitiIds[citiId] {
+		return
+	}
+	log.Printf("%s discard -- %d", txt, citiId)
+}
+
 func (info *SessionInfo) hasCiti() bool {
 	sessionMgr.mutex.get("hasCiti")
 	defer sessionMgr.mutex.rel()
@@ -501,10 +974,15 @@ func CreateConnInfo(
 // 再送信パケット番号の送信
 //
 // @param readNo 接続先の読み込み済みパケット No
-func (sessionInfo *SessionInfo) SetReWrite(readNo int64) {
+// @return error 再送できない場合
+func (sessionInfo *SessionInfo) SetReWrite(readNo int64) error {
 	if sessionInfo.WriteNo > readNo {
 		// こちらが送信したパケット数よりも相手が受け取ったパケット数が少ない場合、
 		// パケットを再送信する。
+		if from := sessionInfo.resendFrom(); readNo < from {
+			return fmt.Errorf(
+				"not found packet to resend -- %d < %d", readNo, from)
+		}
 		sessionInfo.ReWriteNo = readNo
 	} else if sessionInfo.WriteNo == readNo {
 		// こちらが送信したパケット数と、相手が受け取ったパケット数が一致する場合、
@@ -513,8 +991,139 @@ func (sessionInfo *SessionInfo) SetReWrite(readNo int64) {
 	} else {
 		// こちらが送信したパケット数よりも相手が受け取ったパケット数が多い場合、
 		// そんなことはありえないのでエラー
-		log.Fatal("mismatch WriteNo")
+		return fmt.Errorf(
+			"mismatch WriteNo -- %d > %d", readNo, sessionInfo.WriteNo)
+	}
+	return nil
+}
+
+// 再送できる最も古いパケット番号
+func (sessionInfo *SessionInfo) resendFrom() int64 {
+	if item := sessionInfo.WritePackList.Front(); item != nil {
+		return item.Value.(SessionPacket).no
 	}
+	return sessionInfo.WriteNo
+}
+
+// 再接続時に、双方が相手の未受信のパケットを再送できるか確認する
+//
+// @param peerReadNo 相手の読み込み済みパケット No
+// @param peerWriteNo 相手の書き込み済みパケット No
+// @param peerResendFrom 相手が再送できる最も古いパケット番号。旧バージョンの相手は 0 。
+// @return error 再送できないパケットがある場合
+func (sessionInfo *SessionInfo) checkResume(
+	peerReadNo int64, peerWriteNo int64, peerResendFrom int64) error {
+	if peerReadNo > sessionInfo.WriteNo {
+		return fmt.Errorf(
+			"peer read more than wrote -- %d > %d", peerReadNo, sessionInfo.WriteNo)
+	}
+	if from := sessionInfo.resendFrom(); peerReadNo < from {
+		return fmt.Errorf("not found packet to resend -- %d < %d", peerReadNo, from)
+	}
+	if sessionInfo.ReadNo > peerWriteNo {
+		return fmt.Errorf(
+			"read more than peer wrote -- %d > %d", sessionInfo.ReadNo, peerWriteNo)
+	}
+	if sessionInfo.ReadNo < peerWriteNo && sessionInfo.ReadNo < peerResendFrom {
+		return fmt.Errorf(
+			"peer can't resend packet -- %d < %d", sessionInfo.ReadNo, peerResendFrom)
+	}
+	return nil
+}
+
+// セッションをリセットする
+//
+// 再送できないパケットがあるなど、セッションを再開できない場合に呼び出す。
+// セッションの citi を全て RST で中断し、再送用に保持しているパケットを開放する。
+// 再接続を待っている GetSessionConn() は nil を返し、セッションを終了する。
+// 他のセッションには影響しない。
+//
+// @param reason 理由
+func (sessionInfo *SessionInfo) reset(reason string) {
+	done := func() bool {
+		sessionMgr.mutex.get("reset")
+		defer sessionMgr.mutex.rel()
+
+		if sessionInfo.resetReason != "" {
+			return true
+		}
+		sessionInfo.resetReason = reason
+		sessionMgr.resetCount++
+		return false
+	}()
+	if done {
+		return
+	}
+
+	log.Printf("reset session -- %d, %s", sessionInfo.SessionId, reason)
+	sessionInfo.abortAllCiti()
+	// 再送しないので、保持しているパケットを開放する
+	sessionInfo.WritePackList.Init()
+	sessionInfo.ReWriteNo = -1
+	sessionInfo.notifier.notify()
+}
+
+// セッションの全ての citi のローカルの接続を中断する
+//
+// tunnel では通知できない場合に使う。
+func (sessionInfo *SessionInfo) abortAllCiti() {
+	citiList := []*ConnInTunnelInfo{}
+	func() {
+		sessionMgr.mutex.get("abortAllCiti")
+		defer sessionMgr.mutex.rel()
+
+		for _, citi := range sessionInfo.citiId2Info {
+			if citi.citiId >= CITIID_USR {
+				citiList = append(citiList, citi)
+			}
+		}
+	}()
+
+	for _, citi := range citiList {
+		log.Printf(
+			"abort -- %d-%d, %s", sessionInfo.SessionId, citi.citiId,
+			closeReason2str(CLOSE_REASON_SESSION))
+		citi.abort(sessionInfo)
+		// tunnel2Stream() を終了させる
+		select {
+		case citi.readPackChan <- make([]byte, 0):
+		default:
+		}
+	}
+}
+
+// セッションがリセット済みかどうか
+func (sessionInfo *SessionInfo) isReset() bool {
+	sessionMgr.mutex.get("isReset")
+	defer sessionMgr.mutex.rel()
+
+	return sessionInfo.resetReason != ""
+}
+
+// 受信したパケットのシーケンス番号を確認する
+//
+// @param seq シーケンス番号
+// @return bool 受信済みのパケットの場合 true。読み捨てる。
+// @return error 受信していないパケットがある場合
+func (sessionInfo *SessionInfo) checkSeq(seq int64) (bool, error) {
+	if seq == NO_SEQ {
+		return false, fmt.Errorf("no sequence number -- %d", sessionInfo.ReadNo)
+	}
+	if seq < sessionInfo.ReadNo {
+		sessionInfo.dupCount++
+		log.Printf(
+			"duplicated packet -- session %d, seq %d, expected %d",
+			sessionInfo.SessionId, seq, sessionInfo.ReadNo)
+		return true, nil
+	}
+	if seq > sessionInfo.ReadNo {
+		// 再接続すると、相手は ReadNo から再送する
+		sessionInfo.gapCount++
+		return false, fmt.Errorf(
+			"sequence gap -- session %d, seq %d, expected %d",
+			sessionInfo.SessionId, seq, sessionInfo.ReadNo)
+	}
+	return false, nil
 }
 
 // セッション管理
@@ -530,6 +1139,20 @@ type sessionManager struct {
 	conn2alive map[io.ReadWriteCloser]bool
 	// sessionManager 内の値にアクセスする際の mutex
 	mutex Lock
+	// 再開できずにリセットしたセッションの数
+	resetCount int
+	// 破棄したセッションの token → sessionID のマップ。
+	// 破棄したセッションに再接続してきたクライアントに、
+	// 新しいセッションを開始させるために使う。
+	expiredToken2id map[string]int
+	// expiredToken2id に登録した token の登録順のリスト
+	expiredTokenList *list.List
+	// 破棄したセッションの数
+	freeCount int
+	// ERROR_KIND_* → 発生回数
+	error2count map[string]int64
+	// conn2alive の変化の通知
+	connNotifier stateNotifier
 }
 
 var sessionMgr = sessionManager{
@@ -537,17 +1160,151 @@ var sessionMgr = sessionManager{
 	map[int]*ConnInfo{},
 	map[int]*pipeInfo{},
 	map[io.ReadWriteCloser]bool{},
-	Lock{}}
+	Lock{}, 0, map[string]int{}, new(list.List), 0, map[string]int64{},
+	stateNotifier{}}
+
+// プロセス全体ではなく、 citi やセッション単位で処理したエラーの種類
+// 不正な制御メッセージ
+const ERROR_KIND_CTRL = "ctrl"
+
+// 不正なフレーム
+const ERROR_KIND_FRAME = "frame"
+
+// 接続の受け付けの失敗
+const ERROR_KIND_ACCEPT = "accept"
+
+// 待ち受けの開始の失敗
+const ERROR_KIND_LISTEN = "listen"
+
+// citi の登録の失敗
+const ERROR_KIND_CITI = "citi"
+
+// エラーの発生を記録する
+//
+// @param kind ERROR_KIND_*
+func countError(kind string) {
+	sessionMgr.mutex.get("countError")
+	defer sessionMgr.mutex.rel()
+
+	sessionMgr.error2count[kind]++
+}
+
+// 破棄したセッションの token を保持する数
+const EXPIRED_TOKEN_MAX = 1000
+
+// 終了したセッションを破棄する
+//
+// セッション管理から削除して、残っている citi を中断し、
+// packetWriter() などの goroutine を終了させる。
+// 破棄したセッションは、 GC でメモリが開放される。
+//
+// @param info pipe 情報
+func freeSession(info *pipeInfo) {
+	sessionInfo := info.connInfo.SessionInfo
+	func() {
+		sessionMgr.mutex.get("freeSession")
+		defer sessionMgr.mutex.rel()
+
+		delete(sessionMgr.sessionToken2info, sessionInfo.SessionToken)
+		delete(sessionMgr.sessionId2pipe, sessionInfo.SessionId)
+		if connInfo, has := sessionMgr.sessionId2conn[sessionInfo.SessionId]; has {
+			delete(sessionMgr.conn2alive, connInfo.Conn)
+			delete(sessionMgr.sessionId2conn, sessionInfo.SessionId)
+		}
+		if sessionInfo.SessionToken != "" {
+			sessionMgr.expiredToken2id[sessionInfo.SessionToken] = sessionInfo.SessionId
+			sessionMgr.expiredTokenList.PushBack(sessionInfo.SessionToken)
+			if sessionMgr.expiredTokenList.Len() > EXPIRED_TOKEN_MAX {
+				token := sessionMgr.expiredTokenList.Remove(
+					sessionMgr.expiredTokenList.Front()).(string)
+				delete(sessionMgr.expiredToken2id, token)
+			}
+		}
+		sessionMgr.freeCount++
+	}()
+	sessionMgr.connNotifier.notify()
+	log.Printf("free session -- %d", sessionInfo.SessionId)
+
+	sessionInfo.abortAllCiti()
+	// packSched 待ちの packetWriter() を終了させる
+	sessionInfo.packSched.Push(PackInfo{nil, PACKET_KIND_EOS, CITIID_CTRL})
+}
+
+// 指定の token のセッションを破棄済みかどうか
+func isExpiredSession(token string) bool {
+	sessionMgr.mutex.get("isExpiredSession")
+	defer sessionMgr.mutex.rel()
+
+	_, has := sessionMgr.expiredToken2id[token]
+	return has
+}
+
+// セッションを終了する
+//
+// 相手が FEATURE_EOS をサポートしている場合は EOS を送信して、
+// 相手が再接続を待たずにセッションを破棄できるようにする。
+func (info *pipeInfo) terminate() {
+	sessionInfo := info.connInfo.SessionInfo
+	log.Printf("terminate session -- %d", sessionInfo.SessionId)
+
+	sessionMgr.mutex.get("terminate")
+	sessionInfo.terminating = true
+	sessionMgr.mutex.rel()
+
+	info.end = true
+	sessionInfo.packSched.Push(PackInfo{nil, PACKET_KIND_EOS, CITIID_CTRL})
+}
+
+// セッションを終了させているかどうか
+func (sessionInfo *SessionInfo) isTerminating() bool {
+	sessionMgr.mutex.get("isTerminating")
+	defer sessionMgr.mutex.rel()
+
+	return sessionInfo.terminating
+}
+
+// 全てのセッションを終了する
+//
+// @param timeout EOS の送信を待つ最大時間
+func TerminateAllSessions(timeout time.Duration) {
+	infoList := []*pipeInfo{}
+	func() {
+		sessionMgr.mutex.get("TerminateAllSessions")
+		defer sessionMgr.mutex.rel()
+
+		for _, info := range sessionMgr.sessionId2pipe {
+			infoList = append(infoList, info)
+		}
+	}()
+
+	for _, info := range infoList {
+		info.terminate()
+	}
+	limit := time.After(timeout)
+	for _, info := range infoList {
+		select {
+		case <-info.connInfo.SessionInfo.writerEnd:
+		case <-limit:
+			log.Printf("timeout to terminate sessions -- %s", timeout)
+			return
+		}
+	}
+}
 
 // 指定のコネクションをセッション管理に登録する
 func SetSessionConn(connInfo *ConnInfo) {
 	sessionId := connInfo.SessionInfo.SessionId
 	log.Print("SetSessionConn: sessionId -- ", sessionId)
-	sessionMgr.mutex.get("SetSessionConn")
-	defer sessionMgr.mutex.rel()
+	func() {
+		sessionMgr.mutex.get("SetSessionConn")
+		defer sessionMgr.mutex.rel()
 
-	sessionMgr.sessionId2conn[connInfo.SessionInfo.SessionId] = connInfo
-	sessionMgr.conn2alive[connInfo.Conn] = true
+		sessionMgr.sessionId2conn[connInfo.SessionInfo.SessionId] = connInfo
+		sessionMgr.conn2alive[connInfo.Conn] = true
+	}()
+	// 再接続を待っている GetSessionConn() に通知する
+	sessionMgr.connNotifier.notify()
+	connInfo.SessionInfo.notifier.notify()
 }
 
 // 指定のセッション token  に紐付けられた SessionInfo を取得する
@@ -574,10 +1331,11 @@ func JoinUntilToCloseConn(conn io.ReadWriteCloser) {
 	}
 
 	for {
+		notify := sessionMgr.connNotifier.wait()
 		if !isAlive() {
 			break
 		}
-		time.Sleep(500 * time.Millisecond)
+		<-notify
 	}
 	log.Printf("join end -- %v\n", conn)
 }
@@ -603,12 +1361,16 @@ type pipeInfo struct {
 	// 再接続中は true
 	connecting bool
 	// pipe を繋ぐコネクション情報
-	connInfo    *ConnInfo
+	connInfo *ConnInfo
+	// packetReader() と packetWriter() の終了通知
 	fin         chan bool
 	reconnected chan bool
 
 	// citi が server の場合 true
 	citServerFlag bool
+
+	// Tunnel 情報
+	param *TunnelParam
 }
 
 func (info *pipeInfo) sendRelease() {
@@ -638,14 +1400,11 @@ type SessionPacket struct {
 func (sessionInfo *SessionInfo) postWriteData(packInfo *PackInfo) {
 	list := sessionInfo.WritePackList
 	list.PushBack(SessionPacket{no: sessionInfo.WriteNo, pack: *packInfo})
-	if list.Len() > PACKET_NUM {
+	// セッション全体の再送用なので、 citi のリングバッファが小さくても
+	// PACKET_NUM 分は保持する
+	if list.Len() > sessionInfo.ringNum && list.Len() > PACKET_NUM {
 		list.Remove(list.Front())
 	}
-	if PRE_ENC {
-		if (sessionInfo.WriteNo % PACKET_NUM_BASE) == PACKET_NUM_BASE-1 {
-			sessionInfo.encSyncChan <- true
-		}
-	}
 	sessionInfo.WriteNo++
 	sessionInfo.wroteSize += int64(len(packInfo.bytes))
 }
@@ -656,35 +1415,39 @@ func (sessionInfo *SessionInfo) postWriteData(packInfo *PackInfo) {
 //
 // @param info コネクション
 // @param bytes 書き込みデータ
+// @param seq シーケンス番号
 // @return error 失敗した場合 error
-func (info *ConnInfo) writeData(stream io.Writer, citiId uint32, bytes []byte) error {
-	if !PRE_ENC {
-		if err := WriteItem(
-			stream, citiId, bytes, info.CryptCtrlObj, &info.writeBuffer); err != nil {
-			return err
-		}
-	} else {
-		if err := WriteItem(
-			stream, citiId, bytes, nil, &info.writeBuffer); err != nil {
-			return err
-		}
+func (info *ConnInfo) writeData(
+	stream io.Writer, citiId uint32, bytes []byte, seq int64) error {
+	if err := WriteItem(
+		stream, citiId, bytes, info.streamCrypt(), &info.writeBuffer,
+		info.SessionInfo.frameFormat, seq); err != nil {
+		return err
 	}
 	return nil
 }
 
-func (info *ConnInfo) writeDataDirect(stream io.Writer, citiId uint32, bytes []byte) error {
-	if !PRE_ENC {
-		if err := WriteItemDirect(stream, citiId, bytes, info.CryptCtrlObj); err != nil {
-			return err
-		}
-	} else {
-		if err := WriteItemDirect(stream, citiId, bytes, nil); err != nil {
-			return err
-		}
+func (info *ConnInfo) writeDataDirect(
+	stream io.Writer, citiId uint32, bytes []byte, seq int64) error {
+	if err := WriteItemDirect(
+		stream, citiId, bytes, info.streamCrypt(),
+		info.SessionInfo.frameFormat, seq); err != nil {
+		return err
 	}
 	return nil
 }
 
+// セッションのデータの暗号化に使う CryptCtrl を取得する
+//
+// セッションの暗号処理を使う場合は、
+// packetEncrypter() で暗号化済みなので nil を返す。
+func (info *ConnInfo) streamCrypt() *CryptCtrl {
+	if info.SessionInfo.crypt != nil {
+		return nil
+	}
+	return info.CryptCtrlObj
+}
+
 // コネクションからのデータ読み込み
 //
 // @param info コネクション
@@ -695,24 +1458,57 @@ func (info *ConnInfo) readData(work []byte) (*PackItem, error) {
 	var err error
 
 	for {
-		item, err = ReadItem(info.Conn, info.CryptCtrlObj, work, info.SessionInfo)
+		// keep alive などの制御パケットも含めて、
+		// 受信するごとに期限を延ばす
+		setConnReadDeadline(info.Conn, info.SessionInfo.aliveTimeout)
+		item, err = ReadItem(
+			info.Conn, info.streamCrypt(), work, info.SessionInfo,
+			info.SessionInfo.frameFormat)
 		if err != nil {
 			return nil, err
 		}
+		if item.kind != PACKET_KIND_DUMMY && info.SessionInfo.frameFormat.seq {
+			dup, err := info.SessionInfo.checkSeq(item.seq)
+			if err != nil {
+				return nil, err
+			}
+			if dup {
+				// 受信済みのパケットは、復号もせずに読み捨てる
+				continue
+			}
+		}
+		if item.kind == PACKET_KIND_NORMAL && info.SessionInfo.crypt != nil {
+			info.SessionInfo.crypt.dec.Process(item.buf)
+		}
 		if item.kind != PACKET_KIND_DUMMY {
 			info.SessionInfo.ReadNo++
 		}
-		if item.kind == PACKET_KIND_NORMAL {
+		if item.kind == PACKET_KIND_NORMAL || item.kind == PACKET_KIND_EOS ||
+			item.kind == PACKET_KIND_RESET {
 			break
 		}
 		switch item.kind {
+		case PACKET_KIND_CLOSE:
+			info.SessionInfo.recvClose(item.citiId, item.buf)
 		case PACKET_KIND_SYNC:
-			packNo := int64(binary.BigEndian.Uint64(item.buf))
 			// 相手が受けとったら syncChan を更新して、送信処理を進められるように設定
-			if citi := info.SessionInfo.getCiti(item.citiId); citi != nil {
-				citi.syncChan <- packNo
+			if citi := info.SessionInfo.getCiti(item.citiId); citi == nil {
+				info.SessionInfo.discardPacket(item.citiId, "readData")
+			} else if info.SessionInfo.frameFormat.byteWindow {
+				ackedSize := int64(binary.BigEndian.Uint64(item.buf))
+				ackedNo := int64(binary.BigEndian.Uint64(item.buf[8:]))
+				if citi.flow != nil {
+					citi.flow.onAck(ackedSize, ackedNo)
+				}
+				// stream2Tunnel() は canSend() を確認し直すので、
+				// 待っていない場合は通知しなくて良い
+				select {
+				case citi.syncChan <- ackedNo:
+				default:
+				}
 			} else {
-				log.Print("readData discard -- ", item.citiId)
+				packNo := int64(binary.BigEndian.Uint64(item.buf))
+				citi.syncChan <- packNo
 			}
 		default:
 			// 読み飛す。
@@ -737,6 +1533,8 @@ func (info *pipeInfo) reconnect(txt string, rev int) (*ConnInfo, int, bool) {
 	sessionInfo.mutex.get("reconnect")
 	sessionInfo.reconnetWaitState++
 	sessionInfo.mutex.rel()
+	// WaitPauseSession() に通知する
+	sessionInfo.notifier.notify()
 
 	log.Printf("reconnect -- rev: %s, %d %d, %p", txt, rev, workRev, workConnInfo)
 
@@ -764,11 +1562,12 @@ func (info *pipeInfo) reconnect(txt string, rev int) (*ConnInfo, int, bool) {
 
 	if info.reconnectFunc != nil {
 		for {
+			// 他方の reconnect() が再接続を終えるまで待つ
+			notify := sessionInfo.notifier.wait()
 			if sub() {
 				break
 			}
-
-			time.Sleep(500 * time.Millisecond)
+			<-notify
 		}
 	} else {
 		reqConnect = true
@@ -779,17 +1578,22 @@ func (info *pipeInfo) reconnect(txt string, rev int) (*ConnInfo, int, bool) {
 		releaseSessionConn(info)
 		prepareClose(info)
 
-		if len(sessionInfo.packChan) == 0 {
-			// sessionInfo.packChan 待ちで packetWriter が止まらないように
+		if sessionInfo.packSched.Len() == 0 {
+			// sessionInfo.packSched 待ちで packetWriter が止まらないように
 			// dummy を投げる。
-			sessionInfo.packChan <- PackInfo{nil, PACKET_KIND_DUMMY, CITIID_CTRL}
+			sessionInfo.packSched.Push(PackInfo{nil, PACKET_KIND_DUMMY, CITIID_CTRL})
 		}
 
 		if !info.end {
 			sessionInfo.SetState(Session_state_reconnecting)
 
 			workRev = info.rev
-			workInfo := info.reconnectFunc(sessionInfo)
+			var workInfo *ConnInfo
+			if sessionInfo.canResume() {
+				workInfo = info.reconnectFunc(sessionInfo)
+			} else {
+				log.Printf("can't resume -- %d", sessionInfo.SessionId)
+			}
 			if workInfo != nil {
 				info.connInfo = workInfo
 				log.Printf("new connInfo -- %p", workInfo)
@@ -806,9 +1610,9 @@ func (info *pipeInfo) reconnect(txt string, rev int) (*ConnInfo, int, bool) {
 				sessionInfo.mutex.get("reconnectFunc-end")
 				defer sessionInfo.mutex.rel()
 				sessionInfo.reconnetWaitState--
+				info.connecting = false
 			}()
-
-			info.connecting = false
+			sessionInfo.notifier.notify()
 		}
 	}
 
@@ -831,6 +1635,8 @@ func releaseSessionConn(info *pipeInfo) {
 	connInfo.Conn.Close()
 
 	info.sendRelease()
+	// JoinUntilToCloseConn() に通知する
+	sessionMgr.connNotifier.notify()
 }
 
 // 指定のセッションに対応するコネクションを取得する
@@ -847,17 +1653,37 @@ func GetSessionConn(sessionInfo *SessionInfo) *ConnInfo {
 		}
 		return nil
 	}
+	var graceTimer <-chan time.Time
+	if sessionInfo.resumeGrace > 0 {
+		timer := time.NewTimer(sessionInfo.resumeGrace)
+		defer timer.Stop()
+		graceTimer = timer.C
+	}
 	for {
+		// 新しいコネクションの認証が終わったら、すぐに再開する
+		notify := sessionInfo.notifier.wait()
 		if connInfo := sub(); connInfo != nil {
 			log.Print("GetSessionConn ok ... session: ", sessionId)
 			return connInfo
 		}
+		if sessionInfo.isReset() {
+			log.Print("GetSessionConn ng ... session: ", sessionId)
+			return nil
+		}
 		// if !sessionInfo.hasCiti() {
 		//     log.Print( "GetSessionConn ng ... session: ", sessionId )
 		//     return nil
 		// }
 
-		time.Sleep(500 * time.Millisecond)
+		select {
+		case <-notify:
+		case <-graceTimer:
+			// クライアントが戻ってこないので、セッションを破棄する
+			sessionInfo.reset(
+				fmt.Sprintf("resume grace expired -- %s", sessionInfo.resumeGrace))
+			log.Print("GetSessionConn expired ... session: ", sessionId)
+			return nil
+		}
 	}
 }
 
@@ -865,18 +1691,18 @@ func GetSessionConn(sessionInfo *SessionInfo) *ConnInfo {
 func WaitPauseSession(sessionInfo *SessionInfo) bool {
 	log.Print("WaitPauseSession start ... session: ", sessionInfo.SessionId)
 	sub := func() bool {
-		sessionMgr.mutex.get("WaitPauseSession-sub")
-		defer sessionMgr.mutex.rel()
+		sessionInfo.mutex.get("WaitPauseSession-sub")
+		defer sessionInfo.mutex.rel()
 
 		return sessionInfo.reconnetWaitState == 2
 	}
 	for {
+		notify := sessionInfo.notifier.wait()
 		if sub() {
 			log.Print("WaitPauseSession ok ... session: ", sessionInfo.SessionId)
 			return true
 		}
-
-		time.Sleep(500 * time.Millisecond)
+		<-notify
 	}
 }
 
@@ -912,31 +1738,70 @@ func tunnel2Stream(sessionInfo *SessionInfo, dst *ConnInTunnelInfo, fin chan boo
 		}
 		readSize := len(readBuf)
 
-		if (dst.ReadNo % PACKET_NUM_BASE) == PACKET_NUM_BASE-1 {
-			// 一定数読み込んだら SYNC を返す
-			var buffer bytes.Buffer
-			binary.Write(&buffer, binary.BigEndian, dst.ReadNo)
-			dst.ReadState = 30
-			sessionInfo.packChan <- PackInfo{buffer.Bytes(), PACKET_KIND_SYNC, dst.citiId}
+		if sessionInfo.frameFormat.byteWindow {
+			dst.ReadNo++
+			dst.ReadSize += int64(len(readBuf))
+			if sessionInfo.needSync(dst) {
+				// 処理済みのバイト数とパケット数を SYNC で返す
+				var buffer bytes.Buffer
+				binary.Write(&buffer, binary.BigEndian, dst.ReadSize)
+				binary.Write(&buffer, binary.BigEndian, dst.ReadNo)
+				dst.syncedSize = dst.ReadSize
+				dst.syncedNo = dst.ReadNo
+				dst.ReadState = 30
+				sessionInfo.packSched.Push(
+					PackInfo{buffer.Bytes(), PACKET_KIND_SYNC, dst.citiId})
+			}
+		} else {
+			if (dst.ReadNo % PACKET_NUM_BASE) == PACKET_NUM_BASE-1 {
+				// 一定数読み込んだら SYNC を返す
+				var buffer bytes.Buffer
+				binary.Write(&buffer, binary.BigEndian, dst.ReadNo)
+				dst.ReadState = 30
+				sessionInfo.packSched.Push(
+					PackInfo{buffer.Bytes(), PACKET_KIND_SYNC, dst.citiId})
+			}
+			dst.ReadNo++
+			dst.ReadSize += int64(len(readBuf))
 		}
-		dst.ReadNo++
-		dst.ReadSize += int64(len(readBuf))
 
 		if readSize == 0 {
-			log.Printf("tunnel2Stream: read 0 end -- %d", len(sessionInfo.packChan))
+			log.Printf("tunnel2Stream: read 0 end -- %d", sessionInfo.packSched.Len())
+			if dst.halfClose && !dst.isClosing(sessionInfo) {
+				// 相手の書き込みが終了したので、こちらの書き込みも終了する。
+				// 読み込みは stream2Tunnel() で続ける。
+				closeWrite(dst.conn)
+			}
 			break
 		}
+		if dst.comp != nil {
+			var err error
+			if readBuf, err = dst.comp.decompress(readBuf); err != nil {
+				log.Printf("failed to decompress -- %d, %s", dst.citiId, err)
+				if dst.halfClose {
+					dst.abortWithNotify(sessionInfo, CLOSE_REASON_PROTOCOL)
+				}
+				break
+			}
+		}
 		dst.ReadState = 40
 		_, writeerr := dst.conn.Write(readBuf)
 		dst.ReadState = 50
 		if writeerr != nil {
 			log.Printf("write err log: ReadNo=%d, err=%s", dst.ReadNo, writeerr)
+			if dst.halfClose {
+				// 書き込めないので、相手にも送信を止めてもらう
+				dst.abortWithNotify(sessionInfo, CLOSE_REASON_WRITE_ERR)
+			}
 			break
 		}
 	}
 
-	// dst.readPackChan にデータが詰まれないように削除する
-	sessionInfo.delCiti(dst)
+	dst.end = true
+	if !dst.halfClose {
+		// dst.readPackChan にデータが詰まれないように削除する
+		sessionInfo.delCiti(dst)
+	}
 	fin <- true
 }
 
@@ -963,8 +1828,11 @@ func rewirte2Tunnel(info *pipeInfo, connInfoRev *ConnInfoRev) bool {
 				var err error
 
 				cont := true
+				setConnWriteDeadline(
+					connInfoRev.connInfo.Conn, sessionInfo.aliveTimeout)
 				cont, err = writePack(
-					&packet.pack, connInfoRev.connInfo.Conn, connInfoRev.connInfo, false)
+					&packet.pack, connInfoRev.connInfo.Conn, connInfoRev.connInfo, false,
+					packet.no)
 				if !cont {
 					return false
 				}
@@ -990,7 +1858,24 @@ func rewirte2Tunnel(info *pipeInfo, connInfoRev *ConnInfoRev) bool {
 			}
 		}
 		if item == nil {
-			log.Fatal("not found packet ", sessionInfo.ReWriteNo)
+			// 相手が受信していないパケットを既に破棄しているので、
+			// このセッションは再開できない。
+			// 他のセッションを巻き込まないように、このセッションだけをリセットする。
+			reason := fmt.Sprintf("not found packet -- %d", sessionInfo.ReWriteNo)
+			if sessionInfo.caps.hasFeature(FEATURE_RESET) {
+				// 相手が再接続を待たずにセッションを破棄できるように通知する。
+				// 相手が受信を待っているのは ReWriteNo なので、その番号で送る。
+				setConnWriteDeadline(
+					connInfoRev.connInfo.Conn, sessionInfo.aliveTimeout)
+				if err := WriteReset(
+					connInfoRev.connInfo.Conn, reason, sessionInfo.frameFormat,
+					sessionInfo.ReWriteNo); err != nil {
+					log.Printf("failed to write reset -- %s", err)
+				}
+			}
+			sessionInfo.reset(reason)
+			connInfoRev.connInfo.Conn.Close()
+			return false
 		}
 	}
 	return true
@@ -1005,12 +1890,26 @@ func stream2Tunnel(src *ConnInTunnelInfo, info *pipeInfo, fin chan bool) {
 	_, connInfo := info.getConn()
 	sessionInfo := connInfo.SessionInfo
 
-	packChan := sessionInfo.packChan
+	packSched := sessionInfo.packSched
 
 	end := false
 	for !end {
 		src.WriteState = 10
-		if (src.WriteNo % PACKET_NUM_BASE) == 0 {
+		if src.flow != nil {
+			// 相手が処理していないデータがウィンドウを越えないように、
+			// SYNC で空きができるまで待つ。
+			prev := time.Now()
+			for !src.flow.canSend() && !src.isClosing(sessionInfo) && !info.end {
+				<-src.syncChan
+			}
+			span := time.Now().Sub(prev)
+			src.waitTimeInfo.stream2Tunnel += span
+			if IsVerbose() && span >= 5*time.Millisecond {
+				log.Printf(
+					"stream2Tunnel -- %s %s %s",
+					span, src.waitTimeInfo.stream2Tunnel, src.flow)
+			}
+		} else if (src.WriteNo % PACKET_NUM_BASE) == 0 {
 			// tunnel 切断復帰の再接続時の再送信用バッファを残しておくため、
 			// PACKET_NUM_BASE 毎に syncChan を取得し、
 			// 相手が受信していないのに送信し過ぎないようにする。
@@ -1030,16 +1929,31 @@ func stream2Tunnel(src *ConnInTunnelInfo, info *pipeInfo, fin chan bool) {
 
 		// バッファの切り替え
 		buf := src.ringBufW.getNext()
+		readBuf := buf
+		if src.comp != nil {
+			// 圧縮する場合は、先頭に圧縮形式を入れるので空けておく
+			readBuf = buf[COMP_HEADER_SIZE:]
+		}
 
 		var readSize int
 		var readerr error
-		readSize, readerr = src.conn.Read(buf)
+		readSize, readerr = src.conn.Read(readBuf)
 		src.WriteState = 30
 
 		if readerr != nil {
 			log.Printf("read err log: writeNo=%d, err=%s", sessionInfo.WriteNo, readerr)
-			// 入力元が切れたら、転送先に 0 バイトデータを書き込む
-			packChan <- PackInfo{make([]byte, 0), PACKET_KIND_NORMAL, src.citiId}
+			if !src.halfClose {
+				// 入力元が切れたら、転送先に 0 バイトデータを書き込む
+				packSched.Push(PackInfo{make([]byte, 0), PACKET_KIND_NORMAL, src.citiId})
+			} else if readerr == io.EOF {
+				// 入力元の書き込みが終了したことを通知する。
+				// 相手からのデータは tunnel2Stream() で受け続ける。
+				packSched.Push(PackInfo{
+					[]byte{CLOSE_HOW_WRITE, CLOSE_REASON_EOF},
+					PACKET_KIND_CLOSE, src.citiId})
+			} else {
+				src.abortWithNotify(sessionInfo, CLOSE_REASON_READ_ERR)
+			}
 			break
 		}
 		if readSize == 0 {
@@ -1050,7 +1964,8 @@ func stream2Tunnel(src *ConnInTunnelInfo, info *pipeInfo, fin chan bool) {
 
 		src.WriteState = 40
 
-		if (src.WriteNo%PACKET_NUM_BASE) == 0 && len(src.syncChan) == 0 {
+		if src.flow == nil &&
+			(src.WriteNo%PACKET_NUM_BASE) == 0 && len(src.syncChan) == 0 {
 			// パケットグループの最後のパケットで、SYNC が来ていない場合は、
 			// 送信前に SYNC を待つ。
 			work := <-src.syncChan
@@ -1059,7 +1974,15 @@ func stream2Tunnel(src *ConnInTunnelInfo, info *pipeInfo, fin chan bool) {
 		}
 		src.WriteState = 50
 
-		packChan <- PackInfo{buf[:readSize], PACKET_KIND_NORMAL, src.citiId}
+		// 圧縮は暗号化前に行ない、圧縮後のデータを再送用に保持する
+		packet := buf[:readSize]
+		if src.comp != nil {
+			packet = src.comp.compress(buf, readSize)
+		}
+		if src.flow != nil {
+			src.flow.onSend(len(packet))
+		}
+		packSched.Push(PackInfo{packet, PACKET_KIND_NORMAL, src.citiId})
 	}
 	fin <- true
 }
@@ -1069,10 +1992,16 @@ type ConnInfoRev struct {
 	rev      int
 }
 
-func bin2Ctrl(sessionInfo *SessionInfo, buf []byte) {
+// 制御メッセージを処理する
+//
+// @param connInfo コネクション
+// @param buf 制御メッセージ
+// @return error 制御メッセージが不正な場合
+func bin2Ctrl(connInfo *ConnInfo, buf []byte) error {
+	sessionInfo := connInfo.SessionInfo
 	if len(buf) == 0 {
 		log.Print("bin2Ctrl 0")
-		return
+		return nil
 	}
 	kind := buf[0]
 	body := buf[1:]
@@ -1082,30 +2011,53 @@ func bin2Ctrl(sessionInfo *SessionInfo, buf []byte) {
 	switch kind {
 	case CTRL_HEADER:
 		header := ConnHeader{}
-		if err := json.NewDecoder(&buffer).Decode(&header); err != nil {
-			log.Fatal("failed to read header ", err)
+		if err := decodeJSON(&buffer, &header); err != nil {
+			return fmt.Errorf("failed to read header -- %w", err)
 		}
 		log.Print("header ", header)
+		if header.CitiId < CITIID_USR {
+			return fmt.Errorf(
+				"%w -- illegal citiId in header %d", ErrIllegalMessage, header.CitiId)
+		}
+		if sessionInfo.isUsedCitiId(header.CitiId) {
+			// 同じ citi に 2 回接続しないように、使用済みの ID は読み捨てる
+			sessionInfo.discardPacket(header.CitiId, "bin2Ctrl header")
+			return nil
+		}
 		sessionInfo.ctrlInfo.header <- &header
 	case CTRL_RESP_HEADER:
 		resp := CtrlRespHeader{}
-		if err := json.NewDecoder(&buffer).Decode(&resp); err != nil {
-			log.Fatal("failed to read header ", err)
+		if err := decodeJSON(&buffer, &resp); err != nil {
+			return fmt.Errorf("failed to read resp header -- %w", err)
 		}
 		log.Print("resp ", resp)
+		if resp.CitiId < CITIID_USR {
+			return fmt.Errorf(
+				"%w -- illegal citiId in resp %d", ErrIllegalMessage, resp.CitiId)
+		}
 		if citi := sessionInfo.getCiti(resp.CitiId); citi != nil {
-			citi.respHeader <- &resp
+			if !citi.putResp(sessionInfo, &resp) {
+				sessionInfo.closeCanceledCiti(citi, &resp)
+			}
 		} else {
-			log.Print("bin2Ctrl discard -- ", resp.CitiId)
+			sessionInfo.discardPacket(resp.CitiId, "bin2Ctrl")
 		}
+	case CTRL_REKEY:
+		// 以降のパケットは新しい鍵で復号する
+		if err := connInfo.rekey(buf, false); err != nil {
+			return fmt.Errorf("failed to rekey -- %w", err)
+		}
+	default:
+		return fmt.Errorf("%w -- illegal ctrl kind %d", ErrIllegalMessage, kind)
 	}
+	return nil
 }
 
 func packetReader(info *pipeInfo) {
 	rev, connInfo := info.getConn()
 	sessionInfo := connInfo.SessionInfo
 
-	buf := make([]byte, BUFSIZE)
+	buf := make([]byte, sessionInfo.frameFormat.maxSize)
 	for {
 		readSize := 0
 		var citi *ConnInTunnelInfo
@@ -1116,6 +2068,12 @@ func packetReader(info *pipeInfo) {
 				log.Printf(
 					"tunnel read err log: %p, readNo=%d, err=%s",
 					connInfo, sessionInfo.ReadNo, err)
+				if errors.Is(err, ErrIllegalFrame) {
+					// 不正なフレームを送ってくるセッションは、
+					// 再接続しても続けられないので、このセッションだけを終了する
+					countError(ERROR_KIND_FRAME)
+					sessionInfo.reset(err.Error())
+				}
 				end := false
 				connInfo.Conn.Close()
 				connInfo, rev, end = info.reconnect("read", rev)
@@ -1124,14 +2082,38 @@ func packetReader(info *pipeInfo) {
 					info.end = true
 					break
 				}
+			} else if packet.kind == PACKET_KIND_EOS {
+				// 相手がセッションを終了したので、再接続を待たずに破棄する
+				log.Printf("receive eos -- sessionId %d", sessionInfo.SessionId)
+				readSize = 0
+				info.end = true
+				break
+			} else if packet.kind == PACKET_KIND_RESET {
+				// 相手がセッションを再開できないので、再接続を待たずに破棄する
+				sessionInfo.reset(fmt.Sprintf("reset by peer -- %q", packet.buf))
+				readSize = 0
+				info.end = true
+				break
 			} else {
 				sessionInfo.readState = 30
 				if packet.citiId == CITIID_CTRL {
-					bin2Ctrl(sessionInfo, packet.buf)
+					if err := bin2Ctrl(connInfo, packet.buf); err != nil {
+						// 不正な制御メッセージを送ってくるセッションだけを終了する。
+						// リセットしたセッションは再接続しない。
+						log.Printf(
+							"illegal ctrl -- sessionId %d, %s", sessionInfo.SessionId, err)
+						countError(ERROR_KIND_CTRL)
+						sessionInfo.reset(err.Error())
+						connInfo.Conn.Close()
+						connInfo, rev, _ = info.reconnect("ctrl", rev)
+						readSize = 0
+						info.end = true
+						break
+					}
 					// 処理が終わらないように、ダミーで readSize を 1 にセット
 					readSize = 1
 				} else {
-					if citi = sessionInfo.getCiti(packet.citiId); citi != nil {
+					if citi = sessionInfo.getCiti(packet.citiId); citi != nil && !citi.end {
 						// packet.buf は citi.readPackChan に
 						// 入れて別スレッドで処理される。
 						// 一方で packet.buf は、固定アドレスを参照するため、
@@ -1156,7 +2138,7 @@ func packetReader(info *pipeInfo) {
 
 						readSize = len(cloneBuf)
 					} else {
-						log.Printf("packetReader discard -- %d", packet.citiId)
+						sessionInfo.discardPacket(packet.citiId, "packetReader")
 						readSize = 1
 					}
 				}
@@ -1193,6 +2175,7 @@ func packetReader(info *pipeInfo) {
 	}
 
 	prepareClose(info)
+	freeSession(info)
 
 	log.Print("packetReader end -- ", sessionInfo.SessionId)
 	info.fin <- true
@@ -1229,8 +2212,10 @@ func packetWriterSub(
 	for {
 		var writeerr error
 
+		setConnWriteDeadline(connInfoRev.connInfo.Conn, sessionInfo.aliveTimeout)
 		if ret, err := writePack(
-			packet, connInfoRev.connInfo.Conn, connInfoRev.connInfo, true); err != nil {
+			packet, connInfoRev.connInfo.Conn, connInfoRev.connInfo, true,
+			sessionInfo.WriteNo); err != nil {
 			writeerr = err
 		} else if !ret {
 			return false
@@ -1249,67 +2234,65 @@ func packetWriterSub(
 	}
 }
 
-func packetEncrypter(info *pipeInfo) {
-	packChan := info.connInfo.SessionInfo.packChan
-
-	ringBufEnc := info.connInfo.SessionInfo.ringBufEnc
-	encSyncChan := info.connInfo.SessionInfo.encSyncChan
-
-	encNo := uint64(0)
-	for {
-		packet := <-packChan
-
-		switch packet.kind {
-		case PACKET_KIND_NORMAL:
-			if (encNo % PACKET_NUM_BASE) == 0 {
-				<-encSyncChan
-			}
-			encNo++
-		}
-
-		switch packet.kind {
-		case PACKET_KIND_NORMAL:
-			buf := ringBufEnc.getNext()
-			//buf := make([]byte,BUFSIZE)
-
-			if info.connInfo.CryptCtrlObj != nil {
-				packet.bytes = info.connInfo.CryptCtrlObj.enc.Process(
-					packet.bytes, buf)
-			}
-		}
-
-		info.connInfo.SessionInfo.packChanEnc <- packet
-	}
-}
-
 // packet を stream に出力する
 //
 // @param packet パケット
 // @param stream 送信先
 // @param connInfo コネクション
 // @param validPost postWriteData処理をコールする場合 true
+// @param seq シーケンス番号。再送時は送信済みのパケット番号。
 // @return bool 送信を続ける場合 true
 // @return error 送信失敗した場合の error
 func writePack(
 	packet *PackInfo, stream io.Writer,
-	connInfo *ConnInfo, validPost bool) (bool, error) {
+	connInfo *ConnInfo, validPost bool, seq int64) (bool, error) {
 	var writeerr error
 
 	switch packet.kind {
 	case PACKET_KIND_EOS:
 		log.Printf("eos -- sessionId %d", connInfo.SessionInfo.SessionId)
+		if connInfo.SessionInfo.isTerminating() &&
+			connInfo.SessionInfo.caps.hasFeature(FEATURE_EOS) {
+			// セッションの終了を相手に通知する
+			if err := writeKind(
+				stream, []byte{byte(PACKET_KIND_EOS)},
+				connInfo.SessionInfo.frameFormat, seq); err != nil {
+				log.Printf("failed to write eos -- %s", err)
+			}
+		}
 		return false, nil
-	case PACKET_KIND_SYNC:
-		writeerr = WriteSimpleKind(stream, PACKET_KIND_SYNC, packet.citiId, packet.bytes)
+	case PACKET_KIND_SYNC, PACKET_KIND_CLOSE:
+		writeerr = WriteSimpleKind(
+			stream, packet.kind, packet.citiId, packet.bytes,
+			connInfo.SessionInfo.frameFormat, seq)
 	case PACKET_KIND_NORMAL:
-		writeerr = connInfo.writeData(stream, packet.citiId, packet.bytes)
+		writeerr = connInfo.writeData(stream, packet.citiId, packet.bytes, seq)
 	case PACKET_KIND_NORMAL_DIRECT:
-		writeerr = connInfo.writeDataDirect(stream, packet.citiId, packet.bytes)
+		writeerr = connInfo.writeDataDirect(stream, packet.citiId, packet.bytes, seq)
 	case PACKET_KIND_DUMMY:
 		writeerr = WriteDummy(stream)
 		validPost = false
 	default:
-		log.Fatalf("illegal kind -- %d", packet.kind)
+		// 送信できないパケットを飛ばすと相手と不整合になるので、
+		// rewirte2Tunnel() と同じく、このセッションだけをリセットする。
+		connInfo.SessionInfo.reset(fmt.Sprintf("illegal kind -- %d", packet.kind))
+		connInfo.Conn.Close()
+		return false, nil
+	}
+
+	if writeerr == nil && connInfo.SessionInfo.crypt == nil &&
+		packet.citiId == CITIID_CTRL &&
+		(packet.kind == PACKET_KIND_NORMAL || packet.kind == PACKET_KIND_NORMAL_DIRECT) &&
+		len(packet.bytes) > 0 && packet.bytes[0] == CTRL_REKEY {
+		// 鍵更新の通知を送信したので、以降のパケットは新しい鍵で暗号化する。
+		// 再送時も同じ nonce で更新するので、受信側と鍵が一致する。
+		if err := connInfo.rekey(packet.bytes, true); err != nil {
+			// 鍵を更新できないと相手が以降のパケットを復号できないので、
+			// このセッションだけをリセットする。
+			connInfo.SessionInfo.reset(fmt.Sprintf("failed to rekey -- %s", err))
+			connInfo.Conn.Close()
+			return false, nil
+		}
 	}
 
 	if validPost && writeerr == nil {
@@ -1318,18 +2301,86 @@ func writePack(
 	return true, writeerr
 }
 
+// 鍵更新の通知パケットを生成する
+//
+// @return PackInfo 通知パケット
+// @return []byte 鍵更新用の乱数
+func newRekeyPacket() (PackInfo, []byte) {
+	nonce := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(err.Error())
+	}
+	var buffer bytes.Buffer
+	buffer.Write([]byte{CTRL_REKEY})
+	bytes, _ := json.Marshal(&CtrlRekey{base64.StdEncoding.EncodeToString(nonce)})
+	buffer.Write(bytes)
+	return PackInfo{buffer.Bytes(), PACKET_KIND_NORMAL, CITIID_CTRL}, nonce
+}
+
+// 鍵更新の通知に従って鍵を更新する
+//
+// @param buf CTRL_REKEY の制御パケット
+// @param isEnc 暗号化側を更新する場合 true、複合化側を更新する場合 false
+func (info *ConnInfo) rekey(buf []byte, isEnc bool) error {
+	ctrl := info.CryptCtrlObj
+	crypt := info.SessionInfo.crypt
+	if ctrl == nil && crypt == nil {
+		return nil
+	}
+	rekey := CtrlRekey{}
+	if err := decodeJSON(bytes.NewReader(buf[1:]), &rekey); err != nil {
+		return err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(rekey.Nonce)
+	if err != nil {
+		return err
+	}
+	if crypt != nil {
+		// セッションの暗号処理の送信側は packetEncrypter() で更新する
+		crypt.dec.rekey(nonce)
+		log.Printf(
+			"rekey -- sessionId %d, enc false, generation %d",
+			info.SessionInfo.SessionId, crypt.dec.generation)
+		return nil
+	}
+	mode := &ctrl.dec
+	if isEnc {
+		mode = &ctrl.enc
+	}
+	mode.rekey(ctrl.key, nonce)
+	log.Printf(
+		"rekey -- sessionId %d, enc %v, generation %d",
+		info.SessionInfo.SessionId, isEnc, mode.generation)
+	return nil
+}
+
+// 暗号鍵の更新が必要かどうか
+func (info *ConnInfo) needRekey(param *TunnelParam) bool {
+	if info.CryptCtrlObj == nil || info.SessionInfo.crypt != nil {
+		// セッションの暗号処理の鍵は packetEncrypter() で更新する
+		return false
+	}
+	if !info.SessionInfo.caps.hasFeature(FEATURE_REKEY) {
+		// 相手が鍵の更新に対応していない
+		return false
+	}
+	return info.CryptCtrlObj.enc.needRekey(param.rekeySize, param.rekeyInterval)
+}
+
 // Tunnel へのパケット書き込み関数
 //
 // go routine で実行される
 //
 // @param info pipe制御情報
-// @param packChan PackInfo を受けとる channel
 func packetWriter(info *pipeInfo) {
 
 	sessionInfo := info.connInfo.SessionInfo
-	packChan := sessionInfo.packChan
-	if PRE_ENC {
-		packChan = sessionInfo.packChanEnc
+	// 送信するパケットは packSched の優先度順に取り出す
+	popPacket := sessionInfo.packSched.Pop
+	pendingNum := sessionInfo.packSched.Len
+	if sessionInfo.crypt != nil {
+		popPacket = func() PackInfo { return <-sessionInfo.packChanEnc }
+		pendingNum = func() int { return len(sessionInfo.packChanEnc) }
 	}
 
 	var connInfoRev ConnInfoRev
@@ -1337,13 +2388,16 @@ func packetWriter(info *pipeInfo) {
 
 	var buffer bytes.Buffer
 
+	// 結合する最大サイズは、フレームの最大サイズに比例させる
+	maxBatchSize := MAX_PACKET_SIZE * sessionInfo.frameFormat.maxSize / BUFSIZE
+
 	packetNo := 0
 	for {
 		sessionInfo.writeState = 10
 
 		packetNo++
 		prev := time.Now()
-		packet := <-packChan
+		packet := popPacket()
 		span := time.Now().Sub(prev)
 		if span > 500*time.Microsecond {
 			sessionInfo.packetWriterWaitTime += span
@@ -1357,23 +2411,28 @@ func packetWriter(info *pipeInfo) {
 		buffer.Reset()
 
 		end := false
-		for len(packChan) > 0 && packet.kind == PACKET_KIND_NORMAL {
+		for pendingNum() > 0 && packet.kind == PACKET_KIND_NORMAL {
 			// 書き込み依頼が残っている場合、効率化のため一旦 buffer に出力して結合する。
 
-			if buffer.Len()+len(packet.bytes) > MAX_PACKET_SIZE {
+			if buffer.Len()+len(packet.bytes) > maxBatchSize {
 				break
 			}
 
 			if cont, err := writePack(
 				&PackInfo{packet.bytes, PACKET_KIND_NORMAL_DIRECT, packet.citiId},
-				&buffer, connInfoRev.connInfo, true); err != nil {
-				log.Fatal("writePack -- ", err)
+				&buffer, connInfoRev.connInfo, true, sessionInfo.WriteNo); err != nil {
+				// buffer への書き込みに失敗した場合は送信を続けられないので、
+				// このセッションだけをリセットする。
+				sessionInfo.reset(fmt.Sprintf("writePack -- %s", err))
+				connInfoRev.connInfo.Conn.Close()
+				end = true
+				break
 			} else if !cont {
 				end = true
 				break
 			}
 
-			packet = <-packChan
+			packet = popPacket()
 		}
 		if end {
 			break
@@ -1385,6 +2444,7 @@ func packetWriter(info *pipeInfo) {
 			// buffer にデータがセットされていれば、
 			// 結合データがあるので buffer を書き込む
 			//log.Print( "concat -- ", len( buffer.Bytes() ) )
+			setConnWriteDeadline(connInfoRev.connInfo.Conn, sessionInfo.aliveTimeout)
 			if _, err := connInfoRev.connInfo.Conn.Write(buffer.Bytes()); err != nil {
 				log.Printf(
 					"tunnel batch write err log: %p, writeNo=%d, err=%s",
@@ -1403,15 +2463,24 @@ func packetWriter(info *pipeInfo) {
 		if !packetWriterSub(info, &packet, &connInfoRev) {
 			break
 		}
+
+		if connInfoRev.connInfo.needRekey(info.param) {
+			// 一定量・一定時間ごとに暗号鍵を更新する
+			rekeyPacket, _ := newRekeyPacket()
+			if !packetWriterSub(info, &rekeyPacket, &connInfoRev) {
+				break
+			}
+		}
 	}
 
 	log.Print("packetWriter end -- ", sessionInfo.SessionId)
+	close(sessionInfo.writerEnd)
 	info.fin <- true
 
 }
 
 func NewPipeInfo(
-	connInfo *ConnInfo, citServerFlag bool,
+	connInfo *ConnInfo, param *TunnelParam, citServerFlag bool,
 	reconnect func(sessionInfo *SessionInfo) *ConnInfo) (*pipeInfo, bool) {
 
 	sessionMgr.mutex.get("NewPipeInfo")
@@ -1426,17 +2495,17 @@ func NewPipeInfo(
 
 	info = &pipeInfo{
 		0, reconnect, false, false, connInfo,
-		make(chan bool), make(chan bool), citServerFlag}
+		make(chan bool, 2), make(chan bool), citServerFlag, param}
 	sessionMgr.sessionId2pipe[sessionInfo.SessionId] = info
 
 	return info, true
 }
 
 func startRelaySession(
-	connInfo *ConnInfo, interval int, citServerFlag bool,
+	connInfo *ConnInfo, param *TunnelParam, citServerFlag bool,
 	reconnect func(sessionInfo *SessionInfo) *ConnInfo) *pipeInfo {
 
-	info, newSession := NewPipeInfo(connInfo, citServerFlag, reconnect)
+	info, newSession := NewPipeInfo(connInfo, param, citServerFlag, reconnect)
 
 	connInfo.SessionInfo.SetState(Session_state_connected)
 
@@ -1445,14 +2514,33 @@ func startRelaySession(
 		return info
 	}
 
+	sessionInfo := connInfo.SessionInfo
+	sessionInfo.resumeGrace = param.resumeGrace
+	sessionInfo.ringBufMax = param.sessionBufMax
+	interval := param.keepAliveInterval
+	if sessionInfo.caps != nil && sessionInfo.caps.KeepAlive > 0 {
+		// 相手の間隔の方が短い場合は、相手に合わせる。
+		// ただし、サーバが確定した値でも下限より短くはしない。
+		interval = sessionInfo.caps.KeepAlive
+		if interval < KEEP_ALIVE_INTERVAL_MIN {
+			interval = KEEP_ALIVE_INTERVAL_MIN
+		}
+		if param.deadCount > 0 {
+			// 相手も同じ間隔で keep alive を送るので、
+			// その数回分受信がなければ、相手が応答しないとみなす。
+			// 旧バージョンの相手は間隔が分からないので判定しない。
+			sessionInfo.aliveTimeout =
+				time.Duration(interval*param.deadCount) * time.Millisecond
+		}
+	}
+
 	go packetWriter(info)
 	go packetReader(info)
-	if PRE_ENC {
+	if connInfo.SessionInfo.crypt != nil {
+		// 暗号化は packetWriter() とは別に行なう
 		go packetEncrypter(info)
 	}
 
-	sessionInfo := connInfo.SessionInfo
-
 	keepalive := func() {
 		// 一定時間の無通信で切断されないように、 20 秒に一回
 		for !info.end {
@@ -1463,7 +2551,7 @@ func startRelaySession(
 				}
 			}
 			if !info.connecting {
-				sessionInfo.packChan <- PackInfo{nil, PACKET_KIND_DUMMY, CITIID_CTRL}
+				sessionInfo.packSched.Push(PackInfo{nil, PACKET_KIND_DUMMY, CITIID_CTRL})
 			}
 		}
 		log.Printf("end keepalive -- %d", sessionInfo.SessionId)
@@ -1476,6 +2564,9 @@ func startRelaySession(
 // 無通信を避けるため keep alive 用通信を行なう間隔 (ミリ秒)
 const KEEP_ALIVE_INTERVAL = 20 * 1000
 
+// keep alive の間隔の下限 (ミリ秒)。 -int の下限と同じ。
+const KEEP_ALIVE_INTERVAL_MIN = 2 * 1000
+
 // keep alive の時間経過を確認する間隔 (ミリ秒)。
 // これが長いと、 relaySession の後処理の待ち時間がかかる。
 // 短いと、負荷がかかる。
@@ -1493,12 +2584,20 @@ func relaySession(info *pipeInfo, citi *ConnInTunnelInfo, hostInfo HostInfo) {
 
 	sessionInfo := info.connInfo.SessionInfo
 
+	citi.flow = sessionInfo.newFlowCtrl(info.param)
 	go stream2Tunnel(citi, info, fin)
 	go tunnel2Stream(sessionInfo, citi, fin)
 
 	<-fin
-	citi.conn.Close()
+	if !citi.halfClose {
+		citi.conn.Close()
+	}
 	<-fin
+	if citi.halfClose {
+		// half-close の場合は、送信と受信の両方が終了してから close する
+		citi.conn.Close()
+		sessionInfo.delCiti(citi)
+	}
 	log.Printf(
 		"close citi: sessionId %d, citiId %d, read %d, write %d",
 		sessionInfo.SessionId, citi.citiId, citi.ReadSize, citi.WriteSize)
@@ -1515,7 +2614,7 @@ func relaySession(info *pipeInfo, citi *ConnInTunnelInfo, hostInfo HostInfo) {
 		sessionInfo.packetWriterWaitTime,
 		citi.waitTimeInfo.packetReader)
 
-	// sessionInfo.packChan <- PackInfo { nil, PACKET_KIND_EOS, CITIID_CTRL } // pending
+	// sessionInfo.packSched.Push( PackInfo { nil, PACKET_KIND_EOS, CITIID_CTRL } ) // pending
 }
 
 // 再接続情報
@@ -1528,42 +2627,6 @@ type ReconnectInfo struct {
 	Err error
 }
 
-// 再接続をリトライする関数を返す
-func CreateToReconnectFunc(reconnect func(sessionInfo *SessionInfo) ReconnectInfo) func(sessionInfo *SessionInfo) *ConnInfo {
-	return func(sessionInfo *SessionInfo) *ConnInfo {
-		timeList := []time.Duration{
-			500 * time.Millisecond,
-			1000 * time.Millisecond,
-			2000 * time.Millisecond,
-			5000 * time.Millisecond,
-		}
-		index := 0
-		sessionId := 0
-		if sessionInfo != nil {
-			sessionId = sessionInfo.SessionId
-		}
-		for {
-			timeout := timeList[index]
-			log.Printf(
-				"reconnecting... session: %d, timeout: %v", sessionId, timeout)
-			reconnectInfo := reconnect(sessionInfo)
-			if reconnectInfo.Err == nil {
-				log.Print("reconnect -- ok session: ", sessionId)
-				return reconnectInfo.Conn
-			}
-			log.Printf("reconnecting error -- %s\n", reconnectInfo.Err)
-			if !reconnectInfo.Cont {
-				log.Print("reconnect -- ng session: ", sessionId)
-				return nil
-			}
-			time.Sleep(timeout)
-			if index < len(timeList)-1 {
-				index++
-			}
-		}
-	}
-}
-
 type ListenInfo struct {
 	listener    net.Listener
 	forwardInfo ForwardInfo
@@ -1575,73 +2638,262 @@ func (info *ListenInfo) Close() {
 
 type ListenGroup struct {
 	list []ListenInfo
+	// 受け付けた接続を中継するセッション。
+	// 終了したセッションは、次のセッションに切り替わるまで残す。
+	info *pipeInfo
+	// 受け付けを開始済みの場合 true
+	accepting bool
+	// 待ち受けを停止した場合 true
+	closed bool
+	// メンバアクセス排他用 mutex
+	mutex sync.Mutex
+	// セッションの切り替えを待つための cond
+	cond *sync.Cond
 }
 
 func (group *ListenGroup) Close() {
+	func() {
+		group.mutex.Lock()
+		defer group.mutex.Unlock()
+
+		group.closed = true
+		group.cond.Broadcast()
+	}()
 	for _, info := range group.list {
 		info.Close()
 	}
 }
 
-func NewListen(forwardList []ForwardInfo) *ListenGroup {
+// 受け付けた接続を中継するセッションを切り替える
+//
+// 最初に呼ばれた際に、 listen ごとに 1 つだけ受け付けを開始する。
+// 受け付けはセッションが切り替わっても続け、受け付けた接続は
+// その時点のセッションで中継する。
+//
+// @param info 新しいセッション
+func (group *ListenGroup) setPipe(info *pipeInfo) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+
+	group.info = info
+	group.cond.Broadcast()
+	if !group.accepting {
+		group.accepting = true
+		for _, listenInfo := range group.list {
+			go ListenNewConnectSub(listenInfo, group)
+		}
+	}
+}
 
-	group := ListenGroup{[]ListenInfo{}}
+// 受け付けた接続を中継するセッションを取得する
+//
+// セッションが終了している場合、 RECONNECT_MODE_QUEUE なら次のセッションを待つ。
+//
+// @return *pipeInfo セッション。
+// 待ち受けを停止した場合と、 RECONNECT_MODE_REJECT で次のセッションがない場合は nil。
+func (group *ListenGroup) getPipe() *pipeInfo {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+
+	for !group.closed {
+		if !group.info.end {
+			return group.info
+		}
+		if group.info.param.reconnectMode == RECONNECT_MODE_REJECT {
+			return nil
+		}
+		group.cond.Wait()
+	}
+	return nil
+}
+
+// forwardList の Src で待ち受ける
+//
+// @param forwardList 転送情報のリスト
+// @return *ListenGroup 待ち受け情報
+// @return error 待ち受けできないポートがある場合。開始した待ち受けは停止する。
+func NewListen(forwardList []ForwardInfo) (*ListenGroup, error) {
+
+	group := ListenGroup{list: []ListenInfo{}}
+	group.cond = sync.NewCond(&group.mutex)
 
 	for _, forwardInfo := range forwardList {
 		local, err := net.Listen("tcp", forwardInfo.Src.toStr())
 		if err != nil {
-			log.Fatal(err)
-			return nil
+			countError(ERROR_KIND_LISTEN)
+			group.Close()
+			return nil, err
 		}
 		group.list = append(group.list, ListenInfo{local, forwardInfo})
 	}
+	registerListenGroup(&group)
 
-	return &group
+	return &group, nil
 }
 
-func ListenNewConnectSub(
-	listenInfo ListenInfo, info *pipeInfo) {
+// tunnel 再接続中の新しい接続の扱い
+// 再接続を待ってから接続する
+const RECONNECT_MODE_QUEUE = "queue"
 
-	process := func() {
+// すぐに拒否する
+const RECONNECT_MODE_REJECT = "reject"
+
+// 接続先への接続結果を待つ時間の、接続タイムアウトへの追加分
+const CONNECT_RESP_MARGIN = 10 * time.Second
+
+// 接続の受け付けに失敗した場合に、受け付け直すまでの時間
+const ACCEPT_RETRY_INTERVAL = 100 * time.Millisecond
+
+// listen で接続を受け付ける
+//
+// 受け付けはセッションをまたいで続け、受け付けた接続は
+// その時点のセッションで中継する。待ち受けを停止したら返る。
+//
+// @param listenInfo listen 情報
+// @param group listenInfo を持つ ListenGroup
+func ListenNewConnectSub(listenInfo ListenInfo, group *ListenGroup) {
+
+	process := func() bool {
 		log.Printf("wating with %s for %s\n",
 			listenInfo.forwardInfo.Src.toStr(),
 			listenInfo.forwardInfo.Dst.toStr())
 		src, err := listenInfo.listener.Accept()
 		if err != nil {
-			log.Fatal(err)
-		}
-		needClose := true
-		defer func() {
-			if needClose {
-				src.Close()
+			if isDraining() || errors.Is(err, net.ErrClosed) {
+				// 終了処理などで待ち受けを停止した
+				log.Printf("stop listening -- %s", listenInfo.forwardInfo.Src.toStr())
+				return false
 			}
-		}()
+			// fd 不足などの一時的なエラーは、少し待ってから受け付け直す
+			log.Printf("failed to accept -- %s", err)
+			countError(ERROR_KIND_ACCEPT)
+			time.Sleep(ACCEPT_RETRY_INTERVAL)
+			return true
+		}
 
 		log.Printf("ListenNewConnectSub -- %s", src)
 
-		citi := info.connInfo.SessionInfo.addCiti(src, CITIID_CTRL)
-		dst := listenInfo.forwardInfo.Dst
+		// 次のセッションや接続先への接続結果を待つ間も
+		// 次の接続を受け付けられるように、別 goroutine で処理する
+		go connectViaGroup(listenInfo, group, src)
+		return true
+	}
 
-		connInfo := info.connInfo
-		var buffer bytes.Buffer
-		buffer.Write([]byte{CTRL_HEADER})
-		bytes, _ := json.Marshal(&ConnHeader{dst, citi.citiId})
-		buffer.Write(bytes)
+	for {
+		if !process() {
+			break
+		}
+	}
+}
 
-		connInfo.SessionInfo.packChan <- PackInfo{
-			buffer.Bytes(), PACKET_KIND_NORMAL, CITIID_CTRL}
+// 受け付けた接続を、その時点のセッションで中継する
+//
+// @param listenInfo listen 情報
+// @param group listenInfo を持つ ListenGroup
+// @param src 受け付けた接続
+func connectViaGroup(listenInfo ListenInfo, group *ListenGroup, src net.Conn) {
+	info := group.getPipe()
+	if info == nil {
+		// 中継できるセッションがない
+		log.Printf(
+			"reject without session -- %s, %s",
+			src.RemoteAddr(), closeReason2str(CLOSE_REASON_SESSION))
+		resetConn(src)
+		return
+	}
+	if info.connecting && info.param.reconnectMode == RECONNECT_MODE_REJECT {
+		// tunnel の再接続中は、再接続を待たせずにすぐに拒否する
+		log.Printf(
+			"reject while reconnecting -- %s, %s",
+			src.RemoteAddr(), closeReason2str(CLOSE_REASON_REJECTED))
+		resetConn(src)
+		return
+	}
+	connectViaTunnel(listenInfo, info, src)
+}
 
-		respHeader := <-citi.respHeader
-		if respHeader.Result {
-			go relaySession(info, citi, dst)
-			needClose = false
-		} else {
-			log.Printf("failed to connect -- %s:%s", dst.toStr(), respHeader.Mess)
+// listen で受け付けた接続を、 tunnel の先の接続先に接続する
+//
+// @param listenInfo listen 情報
+// @param info pipe 情報
+// @param src 受け付けた接続
+func connectViaTunnel(listenInfo ListenInfo, info *pipeInfo, src net.Conn) {
+	needClose := true
+	defer func() {
+		if needClose {
+			src.Close()
 		}
+	}()
+
+	citi, err := info.connInfo.SessionInfo.addCiti(src, CITIID_CTRL)
+	if err != nil {
+		// このセッションでは新しい接続を中継できないので、接続元に RST で伝える
+		log.Printf("reject -- %s, %s", src.RemoteAddr(), err)
+		countError(ERROR_KIND_CITI)
+		needClose = false
+		resetConn(src)
+		return
 	}
+	dst := listenInfo.forwardInfo.Dst
 
-	for {
-		process()
+	connInfo := info.connInfo
+	compress := selectCompress(
+		listenInfo.forwardInfo.Compress, info.param.compress,
+		connInfo.SessionInfo.caps)
+	citi.comp, _ = NewCitiCompressor(
+		compress, info.param.compMin, connInfo.SessionInfo.frameFormat.maxSize)
+	connInfo.SessionInfo.packSched.SetPriority(
+		citi.citiId, listenInfo.forwardInfo.Priority)
+
+	var buffer bytes.Buffer
+	buffer.Write([]byte{CTRL_HEADER})
+	bytes, _ := json.Marshal(
+		&ConnHeader{
+			dst, citi.citiId, listenInfo.forwardInfo.ProxyProtocol,
+			src.RemoteAddr().String(), src.LocalAddr().String(), compress,
+			listenInfo.forwardInfo.Priority})
+	buffer.Write(bytes)
+
+	connInfo.SessionInfo.packSched.Push(PackInfo{
+		buffer.Bytes(), PACKET_KIND_NORMAL, CITIID_CTRL})
+
+	var respHeader *CtrlRespHeader
+	if info.param.dialTimeout > 0 {
+		// 接続先が応答しない場合に、いつまでも待たないようにする
+		select {
+		case respHeader = <-citi.respHeader:
+		case <-time.After(info.param.dialTimeout + CONNECT_RESP_MARGIN):
+			// タイマーと競合して接続結果が届いている場合は、その結果を使う
+			respHeader = citi.cancelWaitResp(connInfo.SessionInfo)
+			if respHeader == nil {
+				log.Printf("timeout to connect -- %s", dst.toStr())
+				needClose = false
+				resetConn(src)
+				// 相手は遅れて接続する可能性があるので、 citi は接続結果を受けるまで残し、
+				// 接続していた場合は closeCanceledCiti() で切断する。
+				if citi.halfClose {
+					// 接続中の相手に中断を通知する
+					connInfo.SessionInfo.packSched.Push(PackInfo{
+						[]byte{CLOSE_HOW_RESET, CLOSE_REASON_DIAL_FAILED},
+						PACKET_KIND_CLOSE, citi.citiId})
+				}
+				return
+			}
+		}
+	} else {
+		respHeader = <-citi.respHeader
+	}
+	if respHeader.Result {
+		go relaySession(info, citi, dst)
+		needClose = false
+	} else {
+		log.Printf(
+			"failed to connect -- %s:%s, %s", dst.toStr(), respHeader.Mess,
+			closeReason2str(respHeader.Reason))
+		// 接続できなかったことを、ローカルの接続元に RST で伝える
+		needClose = false
+		resetConn(src)
+		connInfo.SessionInfo.delCiti(citi)
 	}
 }
 
@@ -1655,17 +2907,15 @@ func ListenNewConnect(
 	listenGroup *ListenGroup, connInfo *ConnInfo, param *TunnelParam, loop bool,
 	reconnect func(sessionInfo *SessionInfo) *ConnInfo) {
 
-	info := startRelaySession(connInfo, param.keepAliveInterval, true, reconnect)
-
-	for _, listenInfo := range listenGroup.list {
-		go ListenNewConnectSub(listenInfo, info)
-	}
+	info := startRelaySession(connInfo, param, true, reconnect)
+	listenGroup.setPipe(info)
 
 	for {
 		if !<-connInfo.SessionInfo.releaseChan {
 			break
 		}
-		if !loop {
+		if !loop || info.end {
+			// セッションが終了した場合は、呼び出し元で新しいセッションを開始する
 			break
 		}
 	}
@@ -1685,7 +2935,7 @@ func NewConnectFromWith(
 
 	log.Printf("NewConnectFromWith")
 
-	info := startRelaySession(connInfo, param.keepAliveInterval, false, reconnect)
+	info := startRelaySession(connInfo, param, false, reconnect)
 
 	for {
 		header := connInfo.SessionInfo.getHeader()
@@ -1703,26 +2953,90 @@ func NewConnectFromWith(
 func NewConnect(header *ConnHeader, info *pipeInfo) {
 	log.Print("header ", header)
 
+	sessionInfo := info.connInfo.SessionInfo
+
+	// 接続中に listen 側がタイムアウトして中断を通知してきた場合に受けられるように、
+	// 接続前に citi を登録しておく
+	citi, err := sessionInfo.addCiti(nil, header.CitiId)
+	if err != nil {
+		log.Printf("failed to add citi -- %s", err)
+		countError(ERROR_KIND_CITI)
+		// listen 側が接続結果を待ち続けないように、拒否したことを返す
+		pushRespHeader(sessionInfo, &CtrlRespHeader{
+			false, err.Error(), header.CitiId, CLOSE_REASON_REJECTED})
+		return
+	}
+	// listen 側と同じ優先度で送信する
+	sessionInfo.packSched.SetPriority(citi.citiId, header.Priority)
+
+	proxyProtocol, err := sessionInfo.checkProxyProtocol(header)
+	if err != nil {
+		log.Printf("reject -- %d-%d, %s", sessionInfo.SessionId, header.CitiId, err)
+		pushRespHeader(sessionInfo, &CtrlRespHeader{
+			false, err.Error(), header.CitiId, CLOSE_REASON_PROTOCOL})
+		sessionInfo.delCiti(citi)
+		return
+	}
+
 	dstAddr := header.HostInfo.toStr()
-	dst, err := net.Dial("tcp", dstAddr)
-	log.Print("NewConnect -- %s", dst)
+	// 応答しない接続先で citi が止まらないように、 dialTimeout で打ち切る
+	dialer := net.Dialer{Timeout: info.param.dialTimeout}
+	dst, err := dialer.Dial("tcp", dstAddr)
+	log.Printf("NewConnect -- %v", dst)
+	if err == nil {
+		// 接続中に listen 側が中断した場合と、
+		// 接続後に中断された場合とを取りこぼさないように、
+		// closing の確認と conn の設定を排他して行なう
+		sessionInfo.mutex.get("NewConnect")
+		closing := citi.closing
+		if !closing {
+			citi.conn = dst
+		}
+		sessionInfo.mutex.rel()
+		if closing {
+			log.Printf("canceled to connect -- %s", dstAddr)
+			dst.Close()
+			// listen 側が citi を解放できるように、接続結果は返す
+			pushRespHeader(sessionInfo, &CtrlRespHeader{
+				false, "canceled", header.CitiId, CLOSE_REASON_DIAL_FAILED})
+			sessionInfo.delCiti(citi)
+			return
+		}
+	}
 
-	sessionInfo := info.connInfo.SessionInfo
+	if err == nil && proxyProtocol != 0 {
+		// 元の接続元アドレスを接続先に伝える
+		setConnWriteDeadline(dst, info.param.dialTimeout)
+		if err = writeProxyHeader(
+			dst, proxyProtocol, header.SrcAddr, header.ListenAddr); err != nil {
+			dst.Close()
+		}
+		setConnWriteDeadline(dst, 0)
+	}
 
-	citi := sessionInfo.addCiti(dst, header.CitiId)
+	var reason byte = CLOSE_REASON_EOF
+	if err != nil {
+		reason = CLOSE_REASON_DIAL_FAILED
+	}
+	var comp *CitiCompressor
+	if err == nil {
+		// listen 側と同じ方式で圧縮する
+		comp, err = NewCitiCompressor(
+			header.Compress, info.param.compMin, sessionInfo.frameFormat.maxSize)
+		if err != nil {
+			reason = CLOSE_REASON_PROTOCOL
+			dst.Close()
+		}
+	}
 
-	var buffer bytes.Buffer
-	buffer.Write([]byte{CTRL_RESP_HEADER})
-	resp := CtrlRespHeader{err == nil, fmt.Sprint(err), header.CitiId}
-	bytes, _ := json.Marshal(&resp)
-	buffer.Write(bytes)
+	citi.comp = comp
 
-	sessionInfo.packChan <- PackInfo{
-		buffer.Bytes(), PACKET_KIND_NORMAL, CITIID_CTRL}
-	const Session_state_header = "respheader"
+	pushRespHeader(
+		sessionInfo, &CtrlRespHeader{err == nil, fmt.Sprint(err), header.CitiId, reason})
 
 	if err != nil {
-		log.Print("fained to connected to ", dstAddr)
+		log.Printf("fained to connected to %s -- %s", dstAddr, closeReason2str(reason))
+		sessionInfo.delCiti(citi)
 		return
 	}
 	defer dst.Close()
@@ -1734,12 +3048,24 @@ func NewConnect(header *ConnHeader, info *pipeInfo) {
 	log.Print("closed")
 }
 
+// 接続結果を listen 側に送信する
+func pushRespHeader(sessionInfo *SessionInfo, resp *CtrlRespHeader) {
+	var buffer bytes.Buffer
+	buffer.Write([]byte{CTRL_RESP_HEADER})
+	bytes, _ := json.Marshal(resp)
+	buffer.Write(bytes)
+
+	sessionInfo.packSched.Push(PackInfo{
+		buffer.Bytes(), PACKET_KIND_NORMAL, CITIID_CTRL})
+}
+
 func prepareClose(info *pipeInfo) {
 	sessionInfo := info.connInfo.SessionInfo
 
-	log.Printf("prepareClose -- %s", sessionInfo.isTunnelServer)
+	log.Printf("prepareClose -- %v", sessionInfo.isTunnelServer)
 
-	if sessionInfo.isTunnelServer {
+	// セッションの終了時は、 NewConnectFromWith() の getHeader() 待ちも解除する
+	if sessionInfo.isTunnelServer || info.end {
 		for len(sessionInfo.ctrlInfo.waitHeaderCount) > 0 {
 			count := len(sessionInfo.ctrlInfo.waitHeaderCount)
 			log.Print("packetReader: put dummy header -- ", count)
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// 制御メッセージのシードを生成する
+func bin2CtrlSeeds(f *testing.F) {
+	ctrl := func(kind byte, val interface{}) []byte {
+		data, _ := json.Marshal(val)
+		return append([]byte{kind}, data...)
+	}
+	f.Add(ctrl(CTRL_HEADER, &ConnHeader{
+		HostInfo{"", "localhost", 80, ""}, CITIID_USR + 1, 1,
+		"127.0.0.1:10000", "127.0.0.1:20000", COMPRESS_DEFLATE, PRIORITY_HIGH}))
+	f.Add(ctrl(CTRL_RESP_HEADER, &CtrlRespHeader{true, "", CITIID_USR, CLOSE_REASON_EOF}))
+	f.Add(ctrl(CTRL_RESP_HEADER, &CtrlRespHeader{
+		false, "refused", CITIID_USR + 2, CLOSE_REASON_DIAL_FAILED}))
+	rekey, _ := newRekeyPacket()
+	f.Add(rekey.bytes)
+	// 使用中の citiId
+	f.Add(ctrl(CTRL_HEADER, &ConnHeader{HostInfo: HostInfo{}, CitiId: CITIID_USR}))
+	// 制御用の citiId
+	f.Add(ctrl(CTRL_RESP_HEADER, &CtrlRespHeader{true, "", CITIID_CTRL, 0}))
+	f.Add([]byte{CTRL_HEADER, '{', '"', 'X', '"', ':', '1', '}'})
+	f.Add([]byte{CTRL_REKEY, '{', '"', 'N', 'o', 'n', 'c', 'e', '"', ':', '"', '!', '"', '}'})
+	f.Add([]byte{CTRL_RESP_HEADER, '{', '}', '{', '}'})
+	f.Add([]byte{0xff})
+	f.Add([]byte{})
+}
+
+// 不正な制御メッセージを受けても、 panic やブロックをしないことを確認する
+func FuzzBin2Ctrl(f *testing.F) {
+	bin2CtrlSeeds(f)
+	pass := "testpass"
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		discardLog(t)
+		connInfo := CreateConnInfo(nil, &pass, 1, nil, true)
+		sessionInfo := connInfo.SessionInfo
+		citi, err := sessionInfo.addCiti(nil, CITIID_USR)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// ctrlInfo.header と citi.respHeader はバッファが 1 なので、
+		// 1 回の bin2Ctrl() でブロックすることはない
+		err = bin2Ctrl(connInfo, buf)
+
+		select {
+		case header := <-sessionInfo.ctrlInfo.header:
+			if err != nil {
+				t.Errorf("header is passed with error -- %s", err)
+			}
+			if header.CitiId < CITIID_USR || header.CitiId == citi.citiId {
+				t.Errorf("illegal citiId in header -- %d", header.CitiId)
+			}
+		default:
+		}
+		select {
+		case resp := <-citi.respHeader:
+			if err != nil {
+				t.Errorf("resp is passed with error -- %s", err)
+			}
+			if resp.CitiId != citi.citiId {
+				t.Errorf("illegal citiId in resp -- %d", resp.CitiId)
+			}
+		default:
+		}
+	})
+}
+
+// 受け付けた接続を、その時点のセッションに渡すことを確認する
+func TestListenGroupPipe(t *testing.T) {
+	discardLog(t)
+	group, err := NewListen([]ForwardInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queueParam := &TunnelParam{reconnectMode: RECONNECT_MODE_QUEUE}
+	info1 := &pipeInfo{param: queueParam}
+	group.setPipe(info1)
+	if group.getPipe() != info1 {
+		t.Errorf("current pipe is not returned")
+	}
+
+	// セッションが終了したら、次のセッションを待つ
+	info1.end = true
+	info2 := &pipeInfo{param: queueParam}
+	pipeChan := make(chan *pipeInfo)
+	go func() {
+		pipeChan <- group.getPipe()
+	}()
+	select {
+	case <-pipeChan:
+		t.Fatal("ended pipe is returned")
+	case <-time.After(10 * time.Millisecond):
+	}
+	group.setPipe(info2)
+	if <-pipeChan != info2 {
+		t.Errorf("next pipe is not returned")
+	}
+
+	// RECONNECT_MODE_REJECT の場合は待たない
+	info3 := &pipeInfo{param: &TunnelParam{reconnectMode: RECONNECT_MODE_REJECT}}
+	group.setPipe(info3)
+	info3.end = true
+	if group.getPipe() != nil {
+		t.Errorf("ended pipe is returned")
+	}
+
+	// 待ち受けを停止したら、待っているものを戻す
+	group.setPipe(info1)
+	go func() {
+		pipeChan <- group.getPipe()
+	}()
+	group.Close()
+	if <-pipeChan != nil {
+		t.Errorf("pipe is returned after close")
+	}
+}
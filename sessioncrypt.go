@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// 並行して暗号化する goroutine の最大数
+const ENC_WORKER_MAX = 4
+
+// 暗号化待ちのパケット数
+const ENC_QUEUE_NUM = PACKET_NUM
+
+// 送信方向ごとの鍵を生成する際のラベル
+const CIPHER_LABEL_S2C = "kptunnel server to client"
+const CIPHER_LABEL_C2S = "kptunnel client to server"
+
+// セッションの 1 方向分の暗号処理
+//
+// 認証後の通信は、コネクションではなくセッションが持つ鍵で暗号化する。
+// パケット番号から IV を決める AES-CTR で、パケットごとに独立して暗号化するので、
+// 暗号化済みのパケットは再接続後もそのまま再送でき、
+// 複数のパケットを並行して暗号化できる。
+type SessionCipher struct {
+	mutex sync.Mutex
+	// パスワードとセッションの秘密情報から生成した鍵。鍵更新時の元にする。
+	baseKey []byte
+	block   cipher.Block
+	// 次に処理するパケット番号
+	no uint64
+	// 暗号化を行なう最大回数。 CryptMode.countMax と同じ。
+	countMax int
+	// 現在の鍵で処理したサイズ
+	processedSize int64
+	// 現在の鍵を設定した時刻
+	keyTime time.Time
+	// 鍵の更新回数
+	generation int
+}
+
+// セッションの暗号処理
+type SessionCrypt struct {
+	enc *SessionCipher
+	dec *SessionCipher
+}
+
+func newSessionCipher(key []byte, countMax int) *SessionCipher {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	return &SessionCipher{
+		baseKey: key, block: block, countMax: countMax, keyTime: time.Now()}
+}
+
+// セッションの暗号処理を生成する
+//
+// 送信方向ごとに、パスワードとセッションの秘密情報から別の鍵を生成する。
+//
+// @param pass パスワード
+// @param count 暗号化回数
+// @param secret セッションの秘密情報
+// @param isTunnelServer 認証のサーバ側の場合 true
+// @return *SessionCrypt 暗号化しない場合は nil
+func NewSessionCrypt(
+	pass *string, count int, secret []byte, isTunnelServer bool) *SessionCrypt {
+	if pass == nil || count == 0 || len(secret) == 0 {
+		return nil
+	}
+	passKey := getKey([]byte(*pass))
+	deriveKey := func(label string) []byte {
+		sum := sha256.Sum256(append(append(append(
+			[]byte{}, passKey...), secret...), []byte(label)...))
+		return sum[:]
+	}
+	encLabel, decLabel := CIPHER_LABEL_C2S, CIPHER_LABEL_S2C
+	if isTunnelServer {
+		encLabel, decLabel = CIPHER_LABEL_S2C, CIPHER_LABEL_C2S
+	}
+	return &SessionCrypt{
+		newSessionCipher(deriveKey(encLabel), count),
+		newSessionCipher(deriveKey(decLabel), count),
+	}
+}
+
+// 次のパケットの鍵とパケット番号を確保する
+//
+// @param size パケットのサイズ
+// @return cipher.Block 鍵
+// @return uint64 パケット番号
+// @return bool 暗号化する場合 true
+func (cip *SessionCipher) next(size int) (cipher.Block, uint64, bool) {
+	cip.mutex.Lock()
+	defer cip.mutex.Unlock()
+
+	no := cip.no
+	cip.no++
+	if cip.countMax == 0 {
+		return nil, no, false
+	}
+	if cip.countMax > 0 && no >= uint64(cip.countMax) {
+		if no == uint64(cip.countMax) {
+			log.Print("crypto is disabled")
+		}
+		return nil, no, false
+	}
+	cip.processedSize += int64(size)
+	return cip.block, no, true
+}
+
+// パケットを暗号・復号する
+//
+// inbuf と outbuf は同じバッファでも良い。
+//
+// @param block 鍵
+// @param no パケット番号
+func cryptPacket(block cipher.Block, no uint64, inbuf []byte, outbuf []byte) {
+	// IV の上位 8 byte をパケット番号にする。
+	// 下位 8 byte はパケット内のブロックのカウンタになるので重複しない。
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv, no)
+	cipher.NewCTR(block, iv).XORKeyStream(outbuf, inbuf)
+}
+
+// 受信したパケットを順番に復号する
+//
+// @param buf パケット。復号したデータで上書きする。
+func (cip *SessionCipher) Process(buf []byte) {
+	if block, no, valid := cip.next(len(buf)); valid {
+		cryptPacket(block, no, buf, buf)
+	}
+}
+
+// 鍵を更新する
+//
+// CryptMode.rekey() と同じく、元の鍵と nonce から新しい鍵を生成する。
+// 更新後の鍵は、この後に next() で確保したパケットから使用する。
+func (cip *SessionCipher) rekey(nonce []byte) {
+	cip.mutex.Lock()
+	defer cip.mutex.Unlock()
+
+	newKey := sha256.Sum256(append(append([]byte{}, cip.baseKey...), nonce...))
+	block, err := aes.NewCipher(newKey[:])
+	if err != nil {
+		panic(err)
+	}
+	cip.block = block
+	cip.processedSize = 0
+	cip.keyTime = time.Now()
+	cip.generation++
+}
+
+// 鍵の更新が必要かどうか
+//
+// @param size この鍵で処理するサイズの上限。 0 以下の場合は制限なし。
+// @param interval この鍵を使用する時間の上限。 0 以下の場合は制限なし。
+func (cip *SessionCipher) needRekey(size int64, interval time.Duration) bool {
+	cip.mutex.Lock()
+	defer cip.mutex.Unlock()
+
+	if cip.countMax == 0 ||
+		(cip.countMax > 0 && cip.no >= uint64(cip.countMax)) {
+		return false
+	}
+	if size > 0 && cip.processedSize >= size {
+		return true
+	}
+	if interval > 0 && time.Now().Sub(cip.keyTime) >= interval {
+		return true
+	}
+	return false
+}
+
+// 暗号化処理中のパケット
+type encJob struct {
+	packet PackInfo
+	block  cipher.Block
+	no     uint64
+	// 暗号化が終ったら close する
+	done chan struct{}
+}
+
+// パケットを暗号化する goroutine
+func encryptWorker(jobChan chan *encJob) {
+	for job := range jobChan {
+		// 再送用に WritePackList で保持するので、パケットごとに新しいバッファに出力する
+		buf := make([]byte, len(job.packet.bytes))
+		cryptPacket(job.block, job.no, job.packet.bytes, buf)
+		job.packet.bytes = buf
+		close(job.done)
+	}
+}
+
+// packSched から取り出したパケットを暗号化して packChanEnc に入れる
+//
+// 暗号化は複数の goroutine で並行して行ない、取り出した順番で packChanEnc に入れる。
+// 鍵の更新もここで行なうので、 packetWriter() は暗号化済みのパケットを送るだけになる。
+//
+// @param info pipe 情報
+func packetEncrypter(info *pipeInfo) {
+	sessionInfo := info.connInfo.SessionInfo
+	enc := sessionInfo.crypt.enc
+
+	workerNum := runtime.NumCPU()
+	if workerNum > ENC_WORKER_MAX {
+		workerNum = ENC_WORKER_MAX
+	}
+	jobChan := make(chan *encJob, ENC_QUEUE_NUM)
+	orderChan := make(chan *encJob, ENC_QUEUE_NUM)
+	for count := 0; count < workerNum; count++ {
+		go encryptWorker(jobChan)
+	}
+	go func() {
+		for job := range orderChan {
+			<-job.done
+			sessionInfo.packChanEnc <- job.packet
+		}
+	}()
+
+	dispatch := func(packet PackInfo) {
+		job := &encJob{packet: packet, done: make(chan struct{})}
+		orderChan <- job
+		if packet.kind != PACKET_KIND_NORMAL {
+			close(job.done)
+			return
+		}
+		var valid bool
+		if job.block, job.no, valid = enc.next(len(packet.bytes)); !valid {
+			close(job.done)
+			return
+		}
+		jobChan <- job
+	}
+
+	for {
+		packet := sessionInfo.packSched.Pop()
+		dispatch(packet)
+		if packet.kind == PACKET_KIND_EOS {
+			break
+		}
+		if packet.kind == PACKET_KIND_NORMAL &&
+			sessionInfo.caps.hasFeature(FEATURE_REKEY) &&
+			enc.needRekey(info.param.rekeySize, info.param.rekeyInterval) {
+			// 一定量・一定時間ごとに暗号鍵を更新する。
+			// 通知は現在の鍵で暗号化し、以降のパケットを新しい鍵で暗号化する。
+			rekeyPacket, nonce := newRekeyPacket()
+			dispatch(rekeyPacket)
+			enc.rekey(nonce)
+			log.Printf(
+				"rekey -- sessionId %d, enc true, generation %d",
+				sessionInfo.SessionId, enc.generation)
+		}
+	}
+	close(jobChan)
+	close(orderChan)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SIGINT を受けた場合の、 citi の終了を待つ最大時間
+const DRAIN_TIMEOUT_INT = 3 * time.Second
+
+// セッションの終了通知を送信するのを待つ最大時間
+const EOS_TIMEOUT = 3 * time.Second
+
+// 終了処理の状態
+type drainState struct {
+	mutex sync.Mutex
+	// 終了処理中の場合 true
+	draining bool
+	// 終了処理を開始した時刻
+	start time.Time
+	// citi の終了を待つ最大時間
+	timeout time.Duration
+	// 終了処理の契機になったシグナル
+	signal os.Signal
+	// 待ち受けを停止する ListenGroup
+	listenGroupList []*ListenGroup
+}
+
+var drainInfo = drainState{}
+
+// 終了処理で待ち受けを停止する ListenGroup を登録する
+func registerListenGroup(group *ListenGroup) {
+	drainInfo.mutex.Lock()
+	defer drainInfo.mutex.Unlock()
+
+	drainInfo.listenGroupList = append(drainInfo.listenGroupList, group)
+}
+
+// 終了処理中かどうか
+func isDraining() bool {
+	drainInfo.mutex.Lock()
+	defer drainInfo.mutex.Unlock()
+
+	return drainInfo.draining
+}
+
+// 通信中の citi の数を取得する
+func countActiveCiti() int {
+	sessionMgr.mutex.get("countActiveCiti")
+	defer sessionMgr.mutex.rel()
+
+	count := 0
+	for _, sessionInfo := range sessionMgr.sessionToken2info {
+		for citiId := range sessionInfo.citiId2Info {
+			if citiId >= CITIID_USR {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// 終了処理の状態を出力する
+func DumpDrain(stream io.Writer) {
+	drainInfo.mutex.Lock()
+	draining := drainInfo.draining
+	start := drainInfo.start
+	timeout := drainInfo.timeout
+	sig := drainInfo.signal
+	drainInfo.mutex.Unlock()
+
+	fmt.Fprintf(stream, "------------\n")
+	if !draining {
+		fmt.Fprintf(stream, "not draining. active citi: %d\n", countActiveCiti())
+		return
+	}
+	fmt.Fprintf(
+		stream, "draining by %s: elapsed %s / %s, active citi: %d\n",
+		sig, time.Now().Sub(start).Round(time.Second), timeout, countActiveCiti())
+}
+
+// 通信中の citi が終了するのを待ってから、プロセスを終了する
+//
+// 新しい接続の待ち受けを停止して、通信中の citi が終わるのを timeout まで待つ。
+// その後、相手にセッションの終了を通知してから終了する。
+//
+// @param sig 契機になったシグナル
+// @param timeout citi の終了を待つ最大時間
+func drainAndExit(sig os.Signal, timeout time.Duration) {
+	drainInfo.mutex.Lock()
+	drainInfo.draining = true
+	drainInfo.start = time.Now()
+	drainInfo.timeout = timeout
+	drainInfo.signal = sig
+	listenGroupList := drainInfo.listenGroupList
+	drainInfo.mutex.Unlock()
+
+	log.Printf("start draining -- %s, timeout %s", sig, timeout)
+	for _, group := range listenGroupList {
+		// 新しいローカルの接続を受け付けない
+		group.Close()
+	}
+
+	limit := time.Now().Add(timeout)
+	for {
+		count := countActiveCiti()
+		if count == 0 {
+			log.Print("drained all citi")
+			break
+		}
+		if !time.Now().Before(limit) {
+			log.Printf("timeout to drain -- active citi %d", count)
+			break
+		}
+		log.Printf(
+			"draining -- active citi %d, remain %s",
+			count, limit.Sub(time.Now()).Round(time.Second))
+		time.Sleep(time.Second)
+	}
+
+	TerminateAllSessions(EOS_TIMEOUT)
+	log.Print("exit")
+	os.Exit(0)
+}
+
+// SIGINT, SIGTERM を受けたら、終了処理を行なってからプロセスを終了する
+//
+// SIGTERM は drainTimeout まで、 SIGINT は DRAIN_TIMEOUT_INT まで citi の終了を待つ。
+// 終了処理中に再度シグナルを受けた場合は、すぐに終了する。
+//
+// @param drainTimeout SIGTERM の場合の citi の終了を待つ最大時間
+func waitShutdown(drainTimeout time.Duration) {
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigchan
+	timeout := drainTimeout
+	if sig == os.Interrupt && timeout > DRAIN_TIMEOUT_INT {
+		timeout = DRAIN_TIMEOUT_INT
+	}
+	go drainAndExit(sig, timeout)
+
+	sig = <-sigchan
+	log.Printf("exit without draining -- %s", sig)
+	os.Exit(1)
+}